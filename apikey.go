@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"regexp"
+)
+
+// apiKeyEnvVar overrides the api_key value from config.json when set.
+const apiKeyEnvVar = "NCBI_API_KEY"
+
+var apiKeyPattern = regexp.MustCompile(`(api_key=)[^&]*`)
+
+// resolveAPIKey returns the NCBI API key to use for this run. The environment
+// variable wins over the config file so a key can be supplied without writing
+// it to disk.
+func resolveAPIKey(loadedConfig *config) string {
+	envKey := os.Getenv(apiKeyEnvVar)
+	if envKey != "" {
+		return envKey
+	}
+	return loadedConfig.APIKey
+}
+
+// buildUserInfo returns the query parameters that identify this tool to the
+// E-utilities services.
+func buildUserInfo(emailAddress string, apiKey string) string {
+	userInfo := "&tool=sciencefair_downloader&email=" + url.QueryEscape(emailAddress)
+	if apiKey != "" {
+		userInfo += "&api_key=" + url.QueryEscape(apiKey)
+	}
+	return userInfo
+}
+
+// requestsPerSecond returns the request budget NCBI allows with or without an
+// API key.
+func requestsPerSecond(apiKey string) int {
+	if apiKey != "" {
+		return apiKeyRequestsPerSecond
+	}
+	return defaultRequestsPerSecond
+}
+
+// redactURL hides the value of any api_key parameter so the URL can be
+// logged safely.
+func redactURL(rawURL string) string {
+	return apiKeyPattern.ReplaceAllString(rawURL, "${1}REDACTED")
+}
+
+// redactError hides the API key in errors returned by the HTTP client, which
+// include the full request URL. A *url.Error further down a chain of wrapped
+// errors is redacted too, and the chain is kept so the error can still be
+// told apart with errors.As.
+func redactError(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	redacted := &url.Error{
+		Op:  urlErr.Op,
+		URL: redactURL(urlErr.URL),
+		Err: urlErr.Err,
+	}
+	if err == error(urlErr) {
+		return redacted
+	}
+	return &redactedError{Message: redactURL(err.Error()), Err: redacted}
+}
+
+// redactedError is a wrapped *url.Error with the API key taken out of its
+// message.
+type redactedError struct {
+	Message string
+	Err     error
+}
+
+func (err *redactedError) Error() string {
+	return err.Message
+}
+
+func (err *redactedError) Unwrap() error {
+	return err.Err
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"./json_definitions"
+	"./xml_definitions"
+)
+
+// The number of articles downloaded at the same time when the config does not
+// say otherwise. Every download still goes through the shared rate limiter.
+const defaultConcurrency = 4
+
+// articleJob holds everything needed to download a single article and save
+// its metadata.
+type articleJob struct {
+	Record   record
+	IDRecord xml_definitions.Record
+	Metadata *xml_definitions.PubmedArticle
+}
+
+// articleResult is handed from a download worker back to the listing writer.
+type articleResult struct {
+	Job   articleJob
+	Entry indexEntry
+	// The journal the article was published in, if its metadata names one.
+	Journal *json_definitions.Journal
+	Err     error
+}
+
+// downloadArticlePool downloads every job using a bounded number of workers.
+// The workers only download articles and write their metadata files; the
+// index and bad listing are written from this goroutine alone so rows are
+// never interleaved. The journal of each indexed article is added to
+// journals, which the caller saves. onSaved is called from the same goroutine
+// after each article is indexed and onFailed after an article is sent to the
+// bad listing.
+// Articles that fail permanently are recorded in the bad listing. Any other
+// error stops the jobs that have not started yet and is returned once the
+// running ones have finished.
+func (client *Client) downloadArticlePool(jobs []articleJob, concurrency int, corpusLayout *layout, index *articleIndex, journals *journalRegistry, badArticleListing *os.File, journal *progressJournal, onSaved func(articleJob), onFailed func(articleJob)) error {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	jobQueue := make(chan articleJob)
+	results := make(chan articleResult)
+	stop := make(chan struct{})
+
+	var workers sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobQueue {
+				results <- client.processArticle(job, corpusLayout, journal)
+			}
+		}()
+	}
+
+	// Feed the workers until everything is queued or something has failed,
+	// then close the results once the last worker is done.
+	go func() {
+	feed:
+		for _, job := range jobs {
+			select {
+			case jobQueue <- job:
+			case <-stop:
+				break feed
+			}
+		}
+		close(jobQueue)
+		workers.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	for result := range results {
+		if result.Err != nil && !isRetryable(result.Err) {
+			reason := "DownloadError"
+			var metadataErr *metadataError
+			if errors.As(result.Err, &metadataErr) {
+				reason = "MetadataError"
+			}
+			err := markArticleFailed(journal, badArticleListing, result.Job.Record, reason)
+			if err != nil {
+				// The article is in neither the index nor the bad listing,
+				// so stop before anything else goes missing.
+				log.Print("issue recording the failure of " + result.Job.Record.ID)
+				if firstErr == nil {
+					firstErr = err
+					close(stop)
+				}
+				continue
+			}
+			if onFailed != nil {
+				onFailed(result.Job)
+			}
+			continue
+		}
+		if result.Err != nil {
+			if firstErr == nil {
+				firstErr = result.Err
+				close(stop)
+			}
+			continue
+		}
+		previous, err := index.Put(result.Entry)
+		var conflict *indexConflictError
+		if errors.As(err, &conflict) {
+			// processRecords turns these away before they are downloaded,
+			// but the index has the final say. The article already indexed
+			// keeps the PMID.
+			log.Print(conflict.Error())
+			err = markArticleFailed(journal, badArticleListing, result.Job.Record, "PMIDConflict")
+			if err == nil {
+				if onFailed != nil {
+					onFailed(result.Job)
+				}
+				continue
+			}
+		} else if err == nil {
+			err = journal.Record(result.Job.Record.ID, result.Job.Record.Link.Updated, stateIndexed, "")
+		}
+		if err == nil && previous != nil {
+			removeReplacedFiles(corpusLayout, *previous, result.Entry)
+		}
+		if err != nil {
+			log.Print("issue writing to the article index")
+			if firstErr == nil {
+				firstErr = err
+				close(stop)
+			}
+			continue
+		}
+		if result.Journal != nil {
+			journals.Add(*result.Journal)
+		}
+		if onSaved != nil {
+			onSaved(result.Job)
+		}
+	}
+	return firstErr
+}
+
+// processArticle downloads a single article, saves its metadata JSON and
+// builds the entry that should be added to the article index. Steps the
+// journal says were already finished by an earlier run are skipped.
+func (client *Client) processArticle(job articleJob, corpusLayout *layout, journal *progressJournal) articleResult {
+	result := articleResult{Job: job}
+	pmcid := job.Record.ID
+	updated := job.Record.Link.Updated
+
+	// The article is stored under the hashed directory names of its first
+	// download, which is the tgz package if there is one.
+	// processRecords has already checked the links, but a bad one must not
+	// take the whole run down with it.
+	hashPath, err := linkHashPath(job.Record.Link.Href)
+	if err != nil {
+		log.Print(err)
+		result.Err = &permanentError{Err: err}
+		return result
+	}
+	articleFolder := corpusLayout.ArticleFolder(hashPath)
+	articlePath := corpusLayout.ArticlePath(hashPath, pmcid)
+	archivePath := corpusLayout.ArchivePath(hashPath, pmcid)
+
+	if !journal.Reached(pmcid, updated, stateExtracted) {
+		// The files are put together in a staging folder and only swapped in
+		// for those of the version already stored once they are all there,
+		// so an update that fails part way leaves the old version alone.
+		// Anything in the staging folder is left over from an interrupted
+		// attempt.
+		stagingFolder := corpusLayout.StagingFolder(hashPath, pmcid)
+		stagedPath := path.Join(stagingFolder, pmcid)
+		err = os.RemoveAll(stagingFolder)
+		if err == nil {
+			err = os.MkdirAll(stagedPath, 0755)
+		}
+		if err != nil {
+			log.Print("issue creating the staging folder of " + pmcid)
+			result.Err = err
+			return result
+		}
+
+		for _, link := range job.Record.Downloads {
+			if link.Format != "tgz" {
+				continue
+			}
+			// Only trust an earlier download if the package is still there.
+			_, statErr := os.Stat(archivePath)
+			if !journal.Reached(pmcid, updated, stateDownloaded) || statErr != nil {
+				var linkURL string
+				linkURL, err = linkHTTPURL(link.Href)
+				if err != nil {
+					err = &permanentError{Err: err}
+				} else {
+					err = client.fetchArticle(linkURL, archivePath)
+				}
+				if err == nil {
+					err = journal.Record(pmcid, updated, stateDownloaded, "")
+				}
+				if err != nil {
+					log.Print(err)
+					result.Err = err
+					return result
+				}
+			}
+
+			err = extractArticle(archivePath, stagingFolder, pmcid)
+			if err != nil {
+				log.Print(err)
+				result.Err = err
+				return result
+			}
+		}
+
+		// PDFs go into the article's folder alongside the package. They are
+		// fetched after it because extracting it clears the folder out.
+		for _, link := range job.Record.Downloads {
+			if link.Format != "pdf" {
+				continue
+			}
+			var linkURL string
+			linkURL, err = linkHTTPURL(link.Href)
+			if err != nil {
+				err = &permanentError{Err: err}
+			} else {
+				err = client.fetchArticle(linkURL, path.Join(stagedPath, linkFileName(link.Href)))
+			}
+			if err != nil {
+				log.Print(err)
+				result.Err = err
+				return result
+			}
+		}
+
+		err = replaceFolder(stagedPath, articlePath)
+		if err != nil {
+			log.Print("issue moving the new version of " + pmcid + " into place")
+			result.Err = err
+			return result
+		}
+		os.RemoveAll(stagingFolder)
+
+		err = journal.Record(pmcid, updated, stateExtracted, "")
+		if err != nil {
+			log.Print(err)
+			result.Err = err
+			return result
+		}
+	}
+
+	entryFile, err := findEntryFile(articlePath, pmcid)
+	if err != nil {
+		log.Print("issue finding the entry file of " + pmcid)
+		result.Err = err
+		return result
+	}
+
+	var metadataJSON *json_definitions.Metadata
+	if job.Metadata != nil {
+		// The article metadata was downloaded in batches from:
+		// https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?db=pubmed&id=PMID
+		// so convert it to the sciencefair JSON format here.
+		metadataJSON, err = convertXMLToJSON(job.Metadata, hashPath, &job.IDRecord.DOI, pmcid)
+	} else {
+		// PubMed has nothing on this article, so use its own NXML instead.
+		metadataJSON, err = readNXMLMetadata(path.Join(articleFolder, entryFile), hashPath, &job.IDRecord.DOI, pmcid)
+	}
+	if err != nil {
+		log.Print("issue converting xml to json")
+		result.Err = err
+		return result
+	}
+	// Point the metadata at what was actually stored. Anything that did not
+	// come in a tgz package was stored as it was downloaded.
+	metadataJSON.EntryFile = entryFile
+	files, err := listArticleFiles(articleFolder, pmcid)
+	if err != nil {
+		log.Print("issue listing the files of " + pmcid)
+		result.Err = err
+		return result
+	}
+	metadataJSON.Files = &files
+	compressionType := "none"
+	if job.Record.Link.Format == "tgz" {
+		compressionType = "tgz"
+	}
+	metadataJSON.CompressionType = &compressionType
+	// The license is whatever the OA service says the article is shared under.
+	// Without one, the license from the NXML is kept if there is one.
+	if job.Record.License != "" {
+		license := job.Record.License
+		metadataJSON.License = &license
+	}
+	metadataString, err := json.Marshal(metadataJSON)
+	if err != nil {
+		log.Print("issue marshalling to json")
+	}
+
+	// Save the metadata string to a json file.
+	// Use name PubMedCentral-PMID-v2.json
+	err = os.MkdirAll(corpusLayout.MetadataFolder(hashPath), 0655)
+	if err != nil {
+		log.Print("issue creating directories for metadata files")
+		result.Err = err
+		return result
+	}
+
+	// Articles are listed by PMID, or by PMCID if they do not have one.
+	listingKey := job.IDRecord.PMID
+	if listingKey == "" {
+		listingKey = pmcid
+	}
+	// Write the metadata next to its final place and rename it over the
+	// metadata of any earlier version, so readers never see half of it.
+	metadataFileName := corpusLayout.MetadataFilePath(hashPath, listingKey)
+	err = ioutil.WriteFile(metadataFileName+".tmp", metadataString, 0655)
+	if err == nil {
+		err = os.Rename(metadataFileName+".tmp", metadataFileName)
+	}
+	if err != nil {
+		os.Remove(metadataFileName + ".tmp")
+		log.Print("issue saving metadata json file")
+		result.Err = err
+		return result
+	}
+
+	// Build the index entry. It is stored under listingKey, the PMID or the
+	// PMCID of an article without one.
+	result.Entry = indexEntry{
+		PMID:    job.IDRecord.PMID,
+		PMCID:   job.IDRecord.PMCID,
+		DOI:     job.IDRecord.DOI,
+		Path:    hashPath,
+		Date:    listingDate(metadataJSON.Date),
+		Updated: updated,
+		License: job.Record.License,
+	}
+	result.Journal = metadataJSON.Journal
+	return result
+}
+
+// replaceFolder moves the folder at stagedPath to targetPath, replacing
+// whatever is there. The old folder is renamed out of the way first and only
+// removed once the new one is in place, so targetPath is never left half
+// written; at worst it is missing between the two renames.
+func replaceFolder(stagedPath string, targetPath string) error {
+	oldPath := targetPath + ".old"
+	err := os.RemoveAll(oldPath)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(targetPath)
+	replacing := err == nil
+	if replacing {
+		err = os.Rename(targetPath, oldPath)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(stagedPath, targetPath)
+	if err != nil {
+		if replacing {
+			os.Rename(oldPath, targetPath)
+		}
+		return err
+	}
+	return os.RemoveAll(oldPath)
+}
+
+// removeReplacedFiles removes what an earlier version of an article left
+// behind that the new version did not overwrite: its folder if it was stored
+// under different hashed folders, and its metadata if that was stored under
+// a different key.
+func removeReplacedFiles(corpusLayout *layout, previous indexEntry, current indexEntry) {
+	if previous.Path != current.Path {
+		err := os.RemoveAll(corpusLayout.ArticlePath(previous.Path, previous.PMCID))
+		if err != nil {
+			log.Print("Unable to remove the old folder of " + previous.PMCID)
+		}
+	}
+	if previous.Path != current.Path || previous.Key() != current.Key() {
+		err := os.Remove(corpusLayout.MetadataFilePath(previous.Path, previous.Key()))
+		if err != nil && !os.IsNotExist(err) {
+			log.Print("Unable to remove the old metadata of " + previous.PMCID)
+		}
+	}
+}
+
+// metadataError is returned when no metadata can be built for an article that
+// has been downloaded.
+type metadataError struct {
+	Err error
+}
+
+func (err *metadataError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *metadataError) Unwrap() error {
+	return err.Err
+}
+
+// readNXMLMetadata builds the metadata of an article from the NXML file at
+// nxmlPath. Articles stored without an NXML, or with one that cannot be read,
+// have no metadata.
+func readNXMLMetadata(nxmlPath string, hashPath string, doi *string, pmcid string) (*json_definitions.Metadata, error) {
+	if strings.ToLower(path.Ext(nxmlPath)) != ".nxml" {
+		return nil, &permanentError{Err: &metadataError{Err: errors.New(pmcid + " has no PMID and no NXML to read its metadata from")}}
+	}
+	nxmlData, err := ioutil.ReadFile(nxmlPath)
+	if err != nil {
+		return nil, &permanentError{Err: &metadataError{Err: err}}
+	}
+	jatsArticle, err := xml_definitions.ParseJATS(nxmlData)
+	if err != nil {
+		log.Print("issue unmarshalling the NXML of " + pmcid)
+		return nil, &permanentError{Err: &metadataError{Err: err}}
+	}
+	metadataJSON, err := convertJATSToJSON(jatsArticle, hashPath, doi, pmcid)
+	if err != nil {
+		return nil, &permanentError{Err: &metadataError{Err: err}}
+	}
+	return metadataJSON, nil
+}
+
+// The MIME types of the files found in PMC packages. Anything else is
+// identified from its first few bytes.
+var articleFileTypes = map[string]string{
+	".nxml": "application/xml",
+	".xml":  "application/xml",
+	".pdf":  "application/pdf",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".png":  "image/png",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".svg":  "image/svg+xml",
+	".txt":  "text/plain",
+	".csv":  "text/csv",
+	".htm":  "text/html",
+	".html": "text/html",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".zip":  "application/zip",
+	".gz":   "application/gzip",
+	".mp4":  "video/mp4",
+	".avi":  "video/x-msvideo",
+	".mov":  "video/quicktime",
+	".mpg":  "video/mpeg",
+	".wav":  "audio/wav",
+	".mp3":  "audio/mpeg",
+}
+
+// listArticleFiles returns every file stored for an article, with names
+// relative to its hashed folders like the entry file, in name order.
+func listArticleFiles(articleFolder string, pmcid string) ([]json_definitions.File, error) {
+	files := []json_definitions.File{}
+	err := filepath.Walk(filepath.Join(articleFolder, pmcid), func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(articleFolder, filePath)
+		if err != nil {
+			return err
+		}
+		mimeType, err := detectFileType(filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, json_definitions.File{
+			Name: filepath.ToSlash(name),
+			Size: info.Size(),
+			MIME: mimeType,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// detectFileType returns the MIME type of the file at filePath, going by its
+// extension if it is a known one and by its contents otherwise.
+func detectFileType(filePath string) (string, error) {
+	mimeType, found := articleFileTypes[strings.ToLower(filepath.Ext(filePath))]
+	if found {
+		return mimeType, nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	length, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:length]), nil
+}
+
+// findEntryFile returns the file a reader should open first, relative to the
+// article's hashed folders. That is the NXML of an extracted tgz package, or
+// the PDF if there is no NXML.
+func findEntryFile(articlePath string, pmcid string) (string, error) {
+	files, err := ioutil.ReadDir(articlePath)
+	if err != nil {
+		return "", &permanentError{Err: err}
+	}
+	pdfFile := ""
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		switch strings.ToLower(path.Ext(file.Name())) {
+		case ".nxml":
+			return pmcid + "/" + file.Name(), nil
+		case ".pdf":
+			if pdfFile == "" {
+				pdfFile = file.Name()
+			}
+		}
+	}
+	if pdfFile == "" {
+		return "", &permanentError{Err: errors.New("no NXML or PDF was stored for " + pmcid)}
+	}
+	return pmcid + "/" + pdfFile, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The longest an article in the bad listing waits between retries, however
+// many times it has failed.
+const maxRetryInterval = 30 * 24 * time.Hour
+
+// badArticle is a row of the bad article listing. The columns are PMCID,
+// Reason, Attempts, FirstSeen and LastAttempt, with the times in RFC 3339.
+// Rows written before attempts were counted only have the first two columns.
+type badArticle struct {
+	PMCID       string
+	Reason      string
+	Attempts    int
+	FirstSeen   string
+	LastAttempt string
+}
+
+func (entry badArticle) String() string {
+	return entry.PMCID + "," + entry.Reason + "," + strconv.Itoa(entry.Attempts) + "," + entry.FirstSeen + "," + entry.LastAttempt
+}
+
+// due reports whether the article should be tried again at now. The wait
+// after the last attempt starts at interval and doubles with every failed
+// attempt, up to maxRetryInterval. Articles that have never had their
+// attempts recorded are always due.
+func (entry badArticle) due(now time.Time, interval time.Duration) bool {
+	lastAttempt, err := time.Parse(time.RFC3339, entry.LastAttempt)
+	if err != nil {
+		return true
+	}
+	wait := interval
+	for attempt := 1; attempt < entry.Attempts && wait < maxRetryInterval; attempt++ {
+		wait *= 2
+	}
+	if wait > maxRetryInterval {
+		wait = maxRetryInterval
+	}
+	return !now.Before(lastAttempt.Add(wait))
+}
+
+// readBadListing returns the rows of the bad listing at listingPath with one
+// row per PMCID, in the order the PMCIDs first appear. A sync appends a new row
+// each time an article fails, so repeated rows are merged: their attempts are
+// added up and the latest reason is kept. A missing listing has no rows.
+func readBadListing(listingPath string) ([]badArticle, error) {
+	entries := []badArticle{}
+	positions := make(map[string]int)
+	err := readListing(listingPath, func(fields []string) {
+		entry := badArticle{PMCID: fields[0], Reason: "unknown", Attempts: 1}
+		if len(fields) > 1 {
+			entry.Reason = fields[1]
+		}
+		if len(fields) > 2 {
+			attempts, err := strconv.Atoi(fields[2])
+			if err == nil && attempts > 0 {
+				entry.Attempts = attempts
+			}
+		}
+		if len(fields) > 4 {
+			entry.FirstSeen = fields[3]
+			entry.LastAttempt = fields[4]
+		}
+
+		position, found := positions[entry.PMCID]
+		if !found {
+			positions[entry.PMCID] = len(entries)
+			entries = append(entries, entry)
+			return
+		}
+		merged := &entries[position]
+		merged.Reason = entry.Reason
+		merged.Attempts += entry.Attempts
+		if merged.FirstSeen == "" || (entry.FirstSeen != "" && entry.FirstSeen < merged.FirstSeen) {
+			merged.FirstSeen = entry.FirstSeen
+		}
+		if entry.LastAttempt > merged.LastAttempt {
+			merged.LastAttempt = entry.LastAttempt
+		}
+	})
+	if err != nil {
+		log.Print("issue reading the bad article listing")
+		return nil, err
+	}
+	return entries, nil
+}
+
+// writeBadListing replaces the bad listing at listingPath with entries. The
+// new listing is written next to the old one and renamed over it, so a crash
+// leaves one or the other in place.
+func writeBadListing(listingPath string, entries []badArticle) error {
+	tempPath := listingPath + ".tmp"
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		log.Print("issue creating the new bad article listing")
+		return err
+	}
+	writer := bufio.NewWriter(tempFile)
+	for _, entry := range entries {
+		_, err = writer.WriteString(entry.String() + "\n")
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	tempFile.Close()
+	if err != nil {
+		log.Print("issue writing the new bad article listing")
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, listingPath)
+}
+
+// retryOptions describes a single run of retryBadArticles.
+type retryOptions struct {
+	// The wait after an article's first failure before it is retried. It
+	// doubles with every further failure.
+	Interval time.Duration
+	// Articles that have failed this many times are no longer retried. Zero
+	// retries them forever.
+	MaxAttempts int
+	Concurrency int
+	DryRun      bool
+}
+
+// retryBadArticles sends the articles in the bad listing that are due for
+// another attempt back through the normal download path. PMIDs and DOIs are
+// often assigned days after an article appears, so many of them resolve on a
+// later try. Articles that are saved this time are dropped from the bad
+// listing and the rest have their attempt counted. The bad listing is then
+// rewritten with only the articles that are still failing.
+func (client *Client) retryBadArticles(target *corpus, runConfig *config, options retryOptions) error {
+	badListingPath := target.Layout.BadArticleListingPath()
+	entries, err := readBadListing(badListingPath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	duePMCIDs := []string{}
+	for _, entry := range entries {
+		if options.MaxAttempts > 0 && entry.Attempts >= options.MaxAttempts {
+			continue
+		}
+		if entry.due(now, options.Interval) {
+			duePMCIDs = append(duePMCIDs, entry.PMCID)
+		}
+	}
+	log.Print(strconv.Itoa(len(duePMCIDs)) + " of the " + strconv.Itoa(len(entries)) + " bad articles are due for another attempt.")
+	if len(duePMCIDs) == 0 {
+		return nil
+	}
+
+	policy, err := parseFormatPolicy(runConfig.Formats)
+	if err != nil {
+		return err
+	}
+	records, missingPMCIDs, err := client.downloadOARecords(duePMCIDs, policy.formatParameter())
+	if err != nil {
+		return err
+	}
+	if options.DryRun {
+		for _, pmcid := range missingPMCIDs {
+			log.Print(pmcid + " is no longer in the open access subset.")
+		}
+		printRecordDownloads(records, policy)
+		return nil
+	}
+
+	// The journal has these articles as failed, which processRecords takes
+	// as finished, so start them again from the beginning.
+	err = target.Journal.RestartFailed(records, "retry")
+	if err != nil {
+		return err
+	}
+
+	// Failures during the retry go to a listing of their own so that they can
+	// be told apart from the failures they are retrying.
+	retryListingPath := badListingPath + ".retry"
+	retryListing, err := os.OpenFile(retryListingPath, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0655)
+	if err != nil {
+		log.Print("Issue creating the retry listing. Permission error?")
+		return err
+	}
+	defer os.Remove(retryListingPath)
+	retryTarget := *target
+	retryTarget.BadArticleListing = retryListing
+
+	// The counts of a retry are not part of any sync, so they are kept out
+	// of config.json.
+	retryConfig := *runConfig
+	retryConfig.ArticlesProcessed = 0
+	retryConfig.BadArticles = 0
+	err = client.processRecords(records, &retryTarget, &retryConfig, options.Concurrency)
+	retryListing.Close()
+	if err != nil {
+		return err
+	}
+
+	retryFailures, err := readBadListing(retryListingPath)
+	if err != nil {
+		return err
+	}
+	failureReasons := make(map[string]string, len(retryFailures))
+	for _, failure := range retryFailures {
+		failureReasons[failure.PMCID] = failure.Reason
+	}
+	for _, pmcid := range missingPMCIDs {
+		failureReasons[pmcid] = "NotInOA"
+	}
+	retried := make(map[string]bool, len(duePMCIDs))
+	for _, pmcid := range duePMCIDs {
+		retried[pmcid] = true
+	}
+
+	attemptTime := now.Format(time.RFC3339)
+	stillFailing := make([]badArticle, 0, len(entries))
+	promoted := 0
+	for _, entry := range entries {
+		if !retried[entry.PMCID] {
+			stillFailing = append(stillFailing, entry)
+			continue
+		}
+		reason, failed := failureReasons[entry.PMCID]
+		if !failed {
+			journalEntry, found := target.Journal.Entry(entry.PMCID)
+			if found && journalEntry.State == stateIndexed {
+				promoted++
+				continue
+			}
+			// Neither saved nor failed, for example because it is no longer
+			// offered in a wanted format. Keep the reason it had.
+			reason = entry.Reason
+		}
+		entry.Reason = reason
+		entry.Attempts++
+		entry.LastAttempt = attemptTime
+		if entry.FirstSeen == "" {
+			entry.FirstSeen = attemptTime
+		}
+		stillFailing = append(stillFailing, entry)
+	}
+
+	// The corpus holds the bad listing open for appending, so it has to be
+	// reopened once the old file has been replaced.
+	err = writeBadListing(badListingPath, stillFailing)
+	if err != nil {
+		return err
+	}
+	target.BadArticleListing.Close()
+	target.BadArticleListing, err = os.OpenFile(badListingPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0655)
+	if err != nil {
+		log.Print("Issue reopening the bad article listing. Permission error?")
+		return err
+	}
+
+	log.Print("Retried " + strconv.Itoa(len(duePMCIDs)) + " bad articles: " + strconv.Itoa(promoted) +
+		" saved, " + strconv.Itoa(len(stillFailing)) + " still in the bad listing.")
+	return nil
+}
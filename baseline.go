@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The number of missing articles handed to processRecords at a time, so the
+// index, bad listing and journal keep up with a baseline of millions of
+// articles instead of only being written at the very end.
+const baselineChunkSize = 1000
+
+// readFileList parses an OA file list such as oa_file_list.csv. The columns
+// are File, Article Citation, Accession ID, Last Updated, PMID and License.
+// The header row and any row without a PMCID are skipped.
+func readFileList(fileListPath string) ([]article, error) {
+	fileList, err := os.Open(fileListPath)
+	if err != nil {
+		log.Print("unable to open the OA file list")
+		return nil, err
+	}
+	defer fileList.Close()
+
+	reader := csv.NewReader(bufio.NewReader(fileList))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	articles := []article{}
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Print("issue reading the OA file list")
+			return nil, err
+		}
+		if len(fields) < 4 || !strings.HasPrefix(fields[2], "PMC") {
+			continue
+		}
+		entry := article{
+			File:            fields[0],
+			ArticleCitation: fields[1],
+			AccessionID:     fields[2],
+			LastUpdated:     fields[3],
+		}
+		if len(fields) > 4 {
+			entry.PMID = fields[4]
+		}
+		if len(fields) > 5 {
+			entry.License = fields[5]
+		}
+		articles = append(articles, entry)
+	}
+	return articles, nil
+}
+
+// recordFromArticle turns an OA file list entry into the record the OA web
+// service would have returned for it. The list only holds tgz packages.
+func recordFromArticle(entry article, packageBaseURL string) record {
+	return record{
+		ID:       entry.AccessionID,
+		Citation: entry.ArticleCitation,
+		License:  entry.License,
+		Links: []recordLink{{
+			Format:  "tgz",
+			Updated: entry.LastUpdated,
+			Href:    packageBaseURL + entry.File,
+		}},
+	}
+}
+
+// indexedPMCIDs returns the PMCIDs that are already in the index.
+func indexedPMCIDs(index *articleIndex) (map[string]bool, error) {
+	indexed := make(map[string]bool)
+	err := index.ForEach(func(entry indexEntry) error {
+		indexed[entry.PMCID] = true
+		return nil
+	})
+	if err != nil {
+		log.Print("issue reading the article index")
+		return nil, err
+	}
+	return indexed, nil
+}
+
+// resolveBaselineRecords returns the records to download for a chunk of the
+// OA file list. The list only describes tgz packages, so unless the policy
+// only wants those each article is looked up in the OA web service to find
+// every format it is offered in. Articles that have left the OA subset since
+// the list was written are returned separately.
+func (client *Client) resolveBaselineRecords(listRecords []record, policy formatPolicy) ([]record, []record, error) {
+	if policy.packagesOnly() {
+		return listRecords, nil, nil
+	}
+	pmcids := make([]string, 0, len(listRecords))
+	for _, listRecord := range listRecords {
+		pmcids = append(pmcids, listRecord.ID)
+	}
+	// Ask for every format, so that an article that is not offered as a PDF
+	// is not taken to have left the OA subset.
+	records, missingPMCIDs, err := client.downloadOARecords(pmcids, "")
+	if err != nil {
+		log.Print("issue looking up the formats of the articles in the OA file list")
+		return nil, nil, err
+	}
+	missing := make(map[string]bool, len(missingPMCIDs))
+	for _, pmcid := range missingPMCIDs {
+		missing[pmcid] = true
+	}
+	goneRecords := []record{}
+	for _, listRecord := range listRecords {
+		if missing[listRecord.ID] {
+			goneRecords = append(goneRecords, listRecord)
+		}
+	}
+	return records, goneRecords, nil
+}
+
+// runBaseline fills the corpus from the full OA file list rather than by
+// paging through the OA web service from the beginning. The list is read
+// from fileListPath, or downloaded into oa_files if that is empty. Only
+// articles missing from the index are downloaded, so an interrupted baseline
+// can simply be run again. Once every article has been handled the sync
+// watermark is moved up to the newest one in the list, or to just before the
+// oldest article that was skipped for not being offered in a wanted format.
+func (client *Client) runBaseline(target *corpus, runConfig *config, fileListPath string, options syncOptions) error {
+	policy, err := parseFormatPolicy(runConfig.Formats)
+	if err != nil {
+		return err
+	}
+	if fileListPath == "" {
+		log.Print("Downloading the OA file list.")
+		fileListPath, err = client.downloadXML(target.Layout.OAFilesPath)
+		if err != nil {
+			log.Print("issue downloading the OA file list")
+			return err
+		}
+	}
+
+	entries, err := readFileList(fileListPath)
+	if err != nil {
+		return err
+	}
+	listed, err := indexedPMCIDs(target.Index)
+	if err != nil {
+		return err
+	}
+
+	missingRecords := []record{}
+	listedUpdates := make(map[string]string)
+	newestUpdate := ""
+	for _, entry := range entries {
+		if entry.LastUpdated > newestUpdate {
+			newestUpdate = entry.LastUpdated
+		}
+		if listed[entry.AccessionID] {
+			continue
+		}
+		missingRecords = append(missingRecords, recordFromArticle(entry, client.PackageBaseURL))
+		listedUpdates[entry.AccessionID] = entry.LastUpdated
+	}
+	log.Print("The OA file list has " + strconv.Itoa(len(entries)) + " articles, " +
+		strconv.Itoa(len(missingRecords)) + " of them are not in the index.")
+
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = runConfig.Concurrency
+	}
+	// The counts of a baseline are not part of any sync, so they are kept
+	// out of config.json.
+	baselineConfig := *runConfig
+	baselineConfig.ArticlesProcessed = 0
+	baselineConfig.BadArticles = 0
+	skipped := 0
+	oldestSkipped := ""
+	for start := 0; start < len(missingRecords); start += baselineChunkSize {
+		end := start + baselineChunkSize
+		if end > len(missingRecords) {
+			end = len(missingRecords)
+		}
+		records, goneRecords, err := client.resolveBaselineRecords(missingRecords[start:end], policy)
+		if err != nil {
+			return err
+		}
+
+		// processRecords would drop articles without a wanted format without
+		// a word, so count them here and keep the watermark below them.
+		wantedRecords := make([]record, 0, len(records))
+		for _, currentRecord := range records {
+			if len(policy.selectLinks(currentRecord.Links)) == 0 {
+				log.Print(currentRecord.ID + " is not offered in any of the wanted formats, skipping it.")
+				skipped++
+				updated := listedUpdates[currentRecord.ID]
+				if oldestSkipped == "" || updated < oldestSkipped {
+					oldestSkipped = updated
+				}
+				continue
+			}
+			wantedRecords = append(wantedRecords, currentRecord)
+		}
+
+		if options.DryRun {
+			for _, goneRecord := range goneRecords {
+				log.Print(goneRecord.ID + " is no longer in the open access subset.")
+			}
+			printRecordDownloads(wantedRecords, policy)
+			continue
+		}
+
+		for _, goneRecord := range goneRecords {
+			log.Print(goneRecord.ID + " is no longer in the open access subset.")
+			goneRecord.Link = goneRecord.Links[0]
+			baselineConfig.BadArticles++
+			err = markArticleFailed(target.Journal, target.BadArticleListing, goneRecord, "NotInOA")
+			if err != nil {
+				return err
+			}
+		}
+		err = client.processRecords(wantedRecords, target, &baselineConfig, concurrency)
+		if err != nil {
+			return err
+		}
+		log.Print("Baseline has handled " + strconv.Itoa(end) + " of " + strconv.Itoa(len(missingRecords)) + " articles.")
+	}
+	if options.DryRun {
+		return nil
+	}
+	log.Print("Baseline saved " + strconv.Itoa(baselineConfig.ArticlesProcessed) + " articles, " + strconv.Itoa(baselineConfig.BadArticles) + " bad, " +
+		strconv.Itoa(skipped) + " skipped for not being offered in a wanted format.")
+
+	// Everything in the list that could be downloaded is now in the corpus,
+	// so the next sync only needs the records updated after the newest one
+	// in it. Skipped articles are left for the sync to list again, so the
+	// watermark stops a second short of the oldest of them. A watermark that
+	// is already later is left alone. The file list and the watermark are
+	// both in NCBI time.
+	newestTime, err := time.ParseInLocation("2006-01-02 15:04:05", newestUpdate, ncbiLocation)
+	if err != nil {
+		log.Print("Unable to read the newest update time in the OA file list. Leaving the watermark alone.")
+		return nil
+	}
+	if oldestSkipped != "" {
+		skippedTime, err := time.ParseInLocation("2006-01-02 15:04:05", oldestSkipped, ncbiLocation)
+		if err != nil {
+			log.Print("Unable to read the update time of a skipped article. Leaving the watermark alone.")
+			return nil
+		}
+		beforeSkipped := skippedTime.Add(-time.Second)
+		if beforeSkipped.Before(newestTime) {
+			newestTime = beforeSkipped
+		}
+	}
+	lastTime, err := time.ParseInLocation("20060102150405", runConfig.LastDate, ncbiLocation)
+	if err != nil || newestTime.After(lastTime) {
+		runConfig.LastDate = newestTime.In(ncbiLocation).Format("20060102150405")
+		err = saveJSON(runConfig, target.Layout.ConfigPath)
+		if err != nil {
+			log.Print("issue saving sync watermark")
+			return err
+		}
+	}
+	return nil
+}
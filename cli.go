@@ -0,0 +1,741 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usageText = `Usage: %s <command> [flags] [arguments]
+
+Commands:
+  baseline [--file-list <path>]
+                              download every article in the OA file list that
+                              is not in the corpus yet
+  sync                        download everything updated since the last sync
+  backfill --from [--until]   download everything updated in a date range
+                              without moving the sync watermark, with the
+                              dates in NCBI time (US Eastern)
+  fetch <PMCID>...            download the given articles
+  retry-bad [--interval <duration>] [--max-attempts <n>]
+                              try the articles in the bad listing again once
+                              they are due, waiting --interval (default 24h)
+                              after the first failure and twice as long after
+                              each further one
+  verify                      check every indexed article is on disk
+  stats                       summarise the corpus and the last sync
+  index import [<csv>]        add an article listing CSV to the index (default
+                              article_listing.csv in oa_files)
+  index export [<csv>]        write the index out as an article listing CSV,
+                              or to stdout if <csv> is -
+  config [<key> <value>]      show config.json, or set email, api_key,
+                              data_root, formats (tgz, pdf, both or
+                              prefer-tgz), required_identifiers (a comma
+                              separated list of pmid and doi) or concurrency.
+                              data_root can only be set in a config file
+                              given with --config or $PMC_CONFIG, since
+                              otherwise config.json is looked for in the data
+                              root and the setting would never be read
+
+Every command accepts:
+  --data-root <path>          where the corpus is kept (default $PMC_DATA_ROOT,
+                              then data_root in config.json, then ./PMCData)
+  --config <path>             the config file to use (default $PMC_CONFIG,
+                              then config.json in the data root)
+
+Every command but verify and stats accepts:
+  --dry-run                   report what would be done without doing it
+
+Commands that download articles also accept:
+  --concurrency <n>           articles to download at once (default from
+                              config.json, or 4)
+
+Flags may come before or after the arguments. Anything after -- is an
+argument.
+`
+
+// The date formats accepted by --from and --until.
+var dateFlagFormats = []string{"2006-01-02", "2006-01-02 15:04:05", "2006-01-02T15:04:05"}
+
+// commonFlags are the flags shared between subcommands. Concurrency and
+// DryRun are only set by the subcommands that register them.
+type commonFlags struct {
+	DataRoot    string
+	ConfigPath  string
+	Concurrency int
+	DryRun      bool
+}
+
+// command is a single subcommand. run is given the parsed common flags and
+// the arguments left over after the flags.
+type command struct {
+	flags *flag.FlagSet
+	run   func(common *commonFlags, args []string) error
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, usageText, path.Base(os.Args[0]))
+}
+
+// newFlagSet returns a flag set for the named subcommand with --data-root
+// and --config already defined.
+func newFlagSet(name string, common *commonFlags) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = printUsage
+	flags.StringVar(&common.DataRoot, "data-root", "", "where the corpus is kept")
+	flags.StringVar(&common.ConfigPath, "config", "", "the config file to use")
+	return flags
+}
+
+// addDryRunFlag defines --dry-run for a subcommand that honours it.
+func addDryRunFlag(flags *flag.FlagSet, common *commonFlags) {
+	flags.BoolVar(&common.DryRun, "dry-run", false, "report what would be done without doing it")
+}
+
+// addConcurrencyFlag defines --concurrency for a subcommand that downloads
+// articles.
+func addConcurrencyFlag(flags *flag.FlagSet, common *commonFlags) {
+	flags.IntVar(&common.Concurrency, "concurrency", 0, "articles to download at once")
+}
+
+// parseCommandArgs parses the flags of a subcommand wherever they are among
+// its arguments and returns the arguments. The flag package stops at the
+// first argument that is not a flag, which would leave "fetch PMC123
+// --dry-run" fetching an article called --dry-run, so parsing starts again
+// after each argument. Everything after -- is an argument.
+func parseCommandArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		remaining := flags.Args()
+		parsed := len(args) - len(remaining)
+		if parsed > 0 && args[parsed-1] == "--" {
+			return append(positional, remaining...), nil
+		}
+		if len(remaining) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, remaining[0])
+		args = remaining[1:]
+	}
+}
+
+// runCommand runs the subcommand named by args[0] and returns the exit
+// status: 0 on success, 1 if the command failed and 2 if it was used wrongly.
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage()
+		return 0
+	}
+
+	common := &commonFlags{}
+	var selected *command
+	switch args[0] {
+	case "baseline":
+		selected = newBaselineCommand(common)
+	case "sync":
+		selected = newSyncCommand(common)
+	case "backfill":
+		selected = newBackfillCommand(common)
+	case "fetch":
+		selected = newFetchCommand(common)
+	case "retry-bad":
+		selected = newRetryBadCommand(common)
+	case "verify":
+		selected = newVerifyCommand(common)
+	case "stats":
+		selected = newStatsCommand(common)
+	case "index":
+		selected = newIndexCommand(common)
+	case "config":
+		selected = newConfigCommand(common)
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command: "+args[0])
+		printUsage()
+		return 2
+	}
+
+	commandArgs, err := parseCommandArgs(selected.flags, args[1:])
+	if err != nil {
+		return 2
+	}
+	err = selected.run(common, commandArgs)
+	if err != nil {
+		var usage *usageError
+		if errors.As(err, &usage) {
+			fmt.Fprintln(os.Stderr, usage.Message)
+			printUsage()
+			return 2
+		}
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// usageError is returned by a subcommand that was given bad arguments.
+type usageError struct {
+	Message string
+}
+
+func (err *usageError) Error() string {
+	return err.Message
+}
+
+// newCommandClient returns a client for the real NCBI services using the
+// email address and API key in runConfig.
+func newCommandClient(runConfig *config) (*Client, error) {
+	if runConfig.EmailAddress == "" {
+		return nil, errors.New("no email address configured, set one with: config email <address>")
+	}
+	return NewClient(runConfig.EmailAddress, resolveAPIKey(runConfig)), nil
+}
+
+// parseDateFlag parses a --from or --until value, which like the times the OA
+// service gives is in NCBI time.
+func parseDateFlag(name string, value string) (time.Time, error) {
+	for _, format := range dateFlagFormats {
+		parsed, err := time.ParseInLocation(format, value, ncbiLocation)
+		if err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, &usageError{Message: "--" + name + " must look like 2006-01-02 or \"2006-01-02 15:04:05\""}
+}
+
+func newBaselineCommand(common *commonFlags) *command {
+	flags := newFlagSet("baseline", common)
+	addConcurrencyFlag(flags, common)
+	addDryRunFlag(flags, common)
+	fileList := flags.String("file-list", "", "a local copy of oa_file_list.csv (default download it)")
+	return &command{flags: flags, run: func(common *commonFlags, args []string) error {
+		if len(args) != 0 {
+			return &usageError{Message: "baseline does not take any arguments"}
+		}
+		runConfig, corpusLayout, err := resolveLayout(common.DataRoot, common.ConfigPath)
+		if err != nil {
+			return err
+		}
+		client, err := newCommandClient(runConfig)
+		if err != nil {
+			return err
+		}
+		target, err := openCorpus(corpusLayout)
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+
+		return client.runBaseline(target, runConfig, *fileList, syncOptions{
+			Concurrency: common.Concurrency,
+			DryRun:      common.DryRun,
+		})
+	}}
+}
+
+func newSyncCommand(common *commonFlags) *command {
+	flags := newFlagSet("sync", common)
+	addConcurrencyFlag(flags, common)
+	addDryRunFlag(flags, common)
+	return &command{flags: flags, run: func(common *commonFlags, args []string) error {
+		if len(args) != 0 {
+			return &usageError{Message: "sync does not take any arguments"}
+		}
+		runConfig, corpusLayout, err := resolveLayout(common.DataRoot, common.ConfigPath)
+		if err != nil {
+			return err
+		}
+		client, err := newCommandClient(runConfig)
+		if err != nil {
+			return err
+		}
+		if runConfig.LastDate == "" {
+			log.Print("There has not been a sync or baseline yet. Running baseline first is much faster than syncing from the beginning.")
+		}
+		return runSync(client, corpusLayout, runConfig, syncOptions{
+			Concurrency: common.Concurrency,
+			DryRun:      common.DryRun,
+		})
+	}}
+}
+
+func newBackfillCommand(common *commonFlags) *command {
+	flags := newFlagSet("backfill", common)
+	addConcurrencyFlag(flags, common)
+	addDryRunFlag(flags, common)
+	from := flags.String("from", "", "the start of the range, such as 2017-01-01")
+	until := flags.String("until", "", "the end of the range (default now)")
+	return &command{flags: flags, run: func(common *commonFlags, args []string) error {
+		if len(args) != 0 {
+			return &usageError{Message: "backfill does not take any arguments"}
+		}
+		if *from == "" {
+			return &usageError{Message: "backfill needs --from"}
+		}
+		options := syncOptions{
+			Concurrency: common.Concurrency,
+			DryRun:      common.DryRun,
+		}
+		var err error
+		options.From, err = parseDateFlag("from", *from)
+		if err != nil {
+			return err
+		}
+		if *until != "" {
+			options.Until, err = parseDateFlag("until", *until)
+			if err != nil {
+				return err
+			}
+		}
+
+		runConfig, corpusLayout, err := resolveLayout(common.DataRoot, common.ConfigPath)
+		if err != nil {
+			return err
+		}
+		client, err := newCommandClient(runConfig)
+		if err != nil {
+			return err
+		}
+		target, err := openCorpus(corpusLayout)
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+
+		// A backfill keeps its own checkpoint and counts so it neither resumes
+		// nor disturbs an interrupted sync.
+		options.CheckpointPath = corpusLayout.BackfillCheckpointPath()
+		backfillConfig := *runConfig
+		err = client.downloadArticles(target, &backfillConfig, options)
+		if err != nil {
+			return err
+		}
+		log.Print("Backfill saved " + strconv.Itoa(backfillConfig.ArticlesProcessed) + " articles, " + strconv.Itoa(backfillConfig.BadArticles) + " bad.")
+		return nil
+	}}
+}
+
+func newFetchCommand(common *commonFlags) *command {
+	flags := newFlagSet("fetch", common)
+	addConcurrencyFlag(flags, common)
+	addDryRunFlag(flags, common)
+	return &command{flags: flags, run: func(common *commonFlags, args []string) error {
+		if len(args) == 0 {
+			return &usageError{Message: "fetch needs at least one PMCID"}
+		}
+		pmcids := make([]string, 0, len(args))
+		for _, arg := range args {
+			pmcid := strings.ToUpper(strings.TrimSpace(arg))
+			if !strings.HasPrefix(pmcid, "PMC") {
+				pmcid = "PMC" + pmcid
+			}
+			_, err := strconv.Atoi(strings.TrimPrefix(pmcid, "PMC"))
+			if err != nil {
+				return &usageError{Message: arg + " is not a PMCID"}
+			}
+			pmcids = append(pmcids, pmcid)
+		}
+
+		runConfig, corpusLayout, err := resolveLayout(common.DataRoot, common.ConfigPath)
+		if err != nil {
+			return err
+		}
+		client, err := newCommandClient(runConfig)
+		if err != nil {
+			return err
+		}
+
+		target, err := openCorpus(corpusLayout)
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+
+		concurrency := common.Concurrency
+		if concurrency <= 0 {
+			concurrency = runConfig.Concurrency
+		}
+		return client.fetchArticles(target, runConfig, pmcids, concurrency, common.DryRun)
+	}}
+}
+
+func newRetryBadCommand(common *commonFlags) *command {
+	flags := newFlagSet("retry-bad", common)
+	addConcurrencyFlag(flags, common)
+	addDryRunFlag(flags, common)
+	interval := flags.Duration("interval", 24*time.Hour, "the wait after the first failure before an article is retried")
+	maxAttempts := flags.Int("max-attempts", 0, "stop retrying articles that have failed this many times (default never)")
+	return &command{flags: flags, run: func(common *commonFlags, args []string) error {
+		if len(args) != 0 {
+			return &usageError{Message: "retry-bad does not take any arguments"}
+		}
+		if *interval < 0 || *maxAttempts < 0 {
+			return &usageError{Message: "--interval and --max-attempts cannot be negative"}
+		}
+
+		runConfig, corpusLayout, err := resolveLayout(common.DataRoot, common.ConfigPath)
+		if err != nil {
+			return err
+		}
+		client, err := newCommandClient(runConfig)
+		if err != nil {
+			return err
+		}
+		target, err := openCorpus(corpusLayout)
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+
+		concurrency := common.Concurrency
+		if concurrency <= 0 {
+			concurrency = runConfig.Concurrency
+		}
+		return client.retryBadArticles(target, runConfig, retryOptions{
+			Interval:    *interval,
+			MaxAttempts: *maxAttempts,
+			Concurrency: concurrency,
+			DryRun:      common.DryRun,
+		})
+	}}
+}
+
+// readListing calls onRow with the fields of each row of a listing CSV. A
+// missing listing has no rows.
+func readListing(listingPath string, onRow func(fields []string)) error {
+	listing, err := os.Open(listingPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer listing.Close()
+
+	scanner := bufio.NewScanner(listing)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		onRow(strings.Split(line, ","))
+	}
+	return scanner.Err()
+}
+
+func newVerifyCommand(common *commonFlags) *command {
+	flags := newFlagSet("verify", common)
+	return &command{flags: flags, run: func(common *commonFlags, args []string) error {
+		if len(args) != 0 {
+			return &usageError{Message: "verify does not take any arguments"}
+		}
+		_, corpusLayout, err := resolveLayout(common.DataRoot, common.ConfigPath)
+		if err != nil {
+			return err
+		}
+
+		checked := 0
+		problems := 0
+		report := func(pmcid string, problem string) {
+			problems++
+			fmt.Println(pmcid + "\t" + problem)
+		}
+		err = readIndex(corpusLayout, func(entry indexEntry) {
+			checked++
+			hashPath, pmcid := entry.Path, entry.PMCID
+
+			articlePath := corpusLayout.ArticlePath(hashPath, pmcid)
+			articleInfo, err := os.Stat(articlePath)
+			if err != nil || !articleInfo.IsDir() {
+				report(pmcid, "article folder is missing")
+			} else if entries, err := ioutil.ReadDir(articlePath); err != nil || len(entries) == 0 {
+				report(pmcid, "article folder is empty")
+			}
+
+			metadataPath := corpusLayout.MetadataFilePath(hashPath, entry.Key())
+			metadataBytes, err := ioutil.ReadFile(metadataPath)
+			if err != nil {
+				report(pmcid, "metadata is missing")
+				return
+			}
+			if !json.Valid(metadataBytes) {
+				report(pmcid, "metadata is not valid JSON")
+			}
+		})
+		if err != nil {
+			log.Print("issue reading the article index")
+			return err
+		}
+
+		log.Print("Checked " + strconv.Itoa(checked) + " articles, found " + strconv.Itoa(problems) + " problems.")
+		if problems > 0 {
+			return errors.New("the corpus failed verification")
+		}
+		return nil
+	}}
+}
+
+func newStatsCommand(common *commonFlags) *command {
+	flags := newFlagSet("stats", common)
+	return &command{flags: flags, run: func(common *commonFlags, args []string) error {
+		if len(args) != 0 {
+			return &usageError{Message: "stats does not take any arguments"}
+		}
+		runConfig, corpusLayout, err := resolveLayout(common.DataRoot, common.ConfigPath)
+		if err != nil {
+			return err
+		}
+		out := os.Stdout
+
+		articles := 0
+		licenses := map[string]int{}
+		err = readIndex(corpusLayout, func(entry indexEntry) {
+			articles++
+			if entry.License == "" {
+				licenses["unknown"]++
+			} else {
+				licenses[entry.License]++
+			}
+		})
+		if err != nil {
+			log.Print("issue reading the article index")
+			return err
+		}
+		badReasons := map[string]int{}
+		badEntries, err := readBadListing(corpusLayout.BadArticleListingPath())
+		if err != nil {
+			return err
+		}
+		badArticles := len(badEntries)
+		for _, entry := range badEntries {
+			badReasons[entry.Reason]++
+		}
+		journalEntries, _, err := readJournal(corpusLayout.JournalPath())
+		if err != nil {
+			return err
+		}
+		journalStates := map[string]int{}
+		for _, entry := range journalEntries {
+			journalStates[string(entry.State)]++
+		}
+
+		fmt.Fprintln(out, "Articles:     "+strconv.Itoa(articles))
+		printCounts(out, licenses)
+		fmt.Fprintln(out, "Bad articles: "+strconv.Itoa(badArticles))
+		printCounts(out, badReasons)
+		fmt.Fprintln(out, "Journal:      "+strconv.Itoa(len(journalEntries))+" articles")
+		printCounts(out, journalStates)
+
+		fmt.Fprintln(out, "Data root:    "+corpusLayout.DataRoot)
+		lastDate := runConfig.LastDate
+		if lastDate == "" {
+			lastDate = "never"
+		}
+		fmt.Fprintln(out, "Last sync:    "+lastDate)
+		if runConfig.RunStarted != "" && runConfig.RunStarted != runConfig.LastDate {
+			fmt.Fprintln(out, "Unfinished sync started "+runConfig.RunStarted)
+		}
+		fmt.Fprintln(out, "Last run:     "+strconv.Itoa(runConfig.PagesProcessed)+" pages, "+
+			strconv.Itoa(runConfig.ArticlesProcessed)+" articles, "+strconv.Itoa(runConfig.BadArticles)+" bad")
+		return nil
+	}}
+}
+
+// printCounts prints one indented line per key, in key order.
+func printCounts(out io.Writer, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintln(out, "  "+key+": "+strconv.Itoa(counts[key]))
+	}
+}
+
+// newIndexCommand moves the corpus between the article index and the CSV
+// article listing it replaced, for tools that still read the listing.
+func newIndexCommand(common *commonFlags) *command {
+	flags := newFlagSet("index", common)
+	addDryRunFlag(flags, common)
+	return &command{flags: flags, run: func(common *commonFlags, args []string) error {
+		if len(args) == 0 || len(args) > 2 || (args[0] != "import" && args[0] != "export") {
+			return &usageError{Message: "index needs import or export and at most one path"}
+		}
+		_, corpusLayout, err := resolveLayout(common.DataRoot, common.ConfigPath)
+		if err != nil {
+			return err
+		}
+		listingPath := corpusLayout.ArticleListingPath()
+		if len(args) == 2 {
+			listingPath = args[1]
+		}
+
+		if args[0] == "import" {
+			_, err = os.Stat(listingPath)
+			if err != nil {
+				return err
+			}
+			if common.DryRun {
+				rows := 0
+				err = readListingCSV(listingPath, func(entry indexEntry) {
+					rows++
+				})
+				if err != nil {
+					return err
+				}
+				log.Print("Would import " + strconv.Itoa(rows) + " rows from " + listingPath)
+				return nil
+			}
+			target, err := openCorpus(corpusLayout)
+			if err != nil {
+				return err
+			}
+			defer target.Close()
+			imported, err := target.Index.importListing(listingPath)
+			if err != nil {
+				return err
+			}
+			count, err := target.Index.Count()
+			if err != nil {
+				return err
+			}
+			log.Print("Imported " + strconv.Itoa(imported) + " rows, the index now holds " + strconv.Itoa(count) + " articles.")
+			return nil
+		}
+
+		_, err = os.Stat(corpusLayout.IndexPath())
+		if err != nil {
+			log.Print("There is no article index to export.")
+			return err
+		}
+		index, err := openIndex(corpusLayout.IndexPath(), true)
+		if err != nil {
+			return err
+		}
+		defer index.Close()
+		if listingPath == "-" {
+			return index.exportListing(os.Stdout)
+		}
+		if common.DryRun {
+			log.Print("Would export the index to " + listingPath)
+			return nil
+		}
+		// Write the listing next to its final place and rename it over any
+		// old one so readers never see half of it.
+		tempPath := listingPath + ".tmp"
+		listing, err := os.Create(tempPath)
+		if err != nil {
+			log.Print("issue creating the article listing")
+			return err
+		}
+		err = index.exportListing(listing)
+		if err == nil {
+			err = listing.Sync()
+		}
+		listing.Close()
+		if err != nil {
+			os.Remove(tempPath)
+			log.Print("issue writing the article listing")
+			return err
+		}
+		return os.Rename(tempPath, listingPath)
+	}}
+}
+
+func newConfigCommand(common *commonFlags) *command {
+	flags := newFlagSet("config", common)
+	addDryRunFlag(flags, common)
+	return &command{flags: flags, run: func(common *commonFlags, args []string) error {
+		if len(args) != 0 && len(args) != 2 {
+			return &usageError{Message: "config takes either no arguments or a key and a value"}
+		}
+		runConfig, corpusLayout, err := resolveLayout(common.DataRoot, common.ConfigPath)
+		if err != nil {
+			return err
+		}
+		configPath := corpusLayout.ConfigPath
+
+		if len(args) == 2 {
+			key, value := args[0], args[1]
+			switch key {
+			case "email":
+				runConfig.EmailAddress = value
+			case "api_key":
+				runConfig.APIKey = value
+			case "data_root":
+				if !explicitConfigPath(common.ConfigPath) {
+					return &usageError{Message: "data_root is only read from a config file given with --config or " + configEnvVar +
+						", otherwise " + configPath + " would never be found again"}
+				}
+				runConfig.DataRoot = value
+			case "required_identifiers":
+				required := []string{}
+				for _, identifier := range strings.Split(value, ",") {
+					if strings.TrimSpace(identifier) != "" {
+						required = append(required, strings.TrimSpace(identifier))
+					}
+				}
+				_, err := parseIdentifierPolicy(required)
+				if err != nil {
+					return &usageError{Message: err.Error()}
+				}
+				runConfig.RequiredIdentifiers = required
+			case "formats":
+				_, err := parseFormatPolicy(value)
+				if err != nil {
+					return &usageError{Message: err.Error()}
+				}
+				runConfig.Formats = value
+			case "concurrency":
+				concurrency, err := strconv.Atoi(value)
+				if err != nil || concurrency < 0 {
+					return &usageError{Message: "concurrency must be a number of at least zero"}
+				}
+				runConfig.Concurrency = concurrency
+			default:
+				return &usageError{Message: "only email, api_key, data_root, formats, required_identifiers and concurrency can be set"}
+			}
+			if !common.DryRun {
+				err = os.MkdirAll(path.Dir(configPath), 0755)
+				if err != nil {
+					return err
+				}
+				err = saveJSON(runConfig, configPath)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// Never print the API key itself.
+		shownConfig := *runConfig
+		if shownConfig.APIKey != "" {
+			shownConfig.APIKey = "REDACTED"
+		}
+		jsonString, err := json.MarshalIndent(shownConfig, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jsonString))
+		return nil
+	}}
+}
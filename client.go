@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"./xml_definitions"
+)
+
+// The NCBI services used by default. Each one is the start of a URL that the
+// request parameters are appended to.
+const defaultUpdateURLBase = "https://www.ncbi.nlm.nih.gov/pmc/utils/oa/oa.fcgi?from="
+const defaultRecordURLBase = "https://www.ncbi.nlm.nih.gov/pmc/utils/oa/oa.fcgi?id="
+const defaultMetadataBaseLink = "https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?db=pubmed&retmode=XML&id="
+const defaultPMCIDBaseLink = "https://www.ncbi.nlm.nih.gov/pmc/utils/idconv/v1.0/?versions=no&idtype=pmcid&ids="
+const defaultFileListURL = "http://ftp.ncbi.nlm.nih.gov/pub/pmc/oa_file_list.csv"
+const defaultPackageBaseURL = "ftp://ftp.ncbi.nlm.nih.gov/pub/pmc/"
+
+// How long a single request, including reading the body, may take before it
+// is abandoned as timed out. Article packages can be large so this is
+// generous.
+const requestTimeout = 10 * time.Minute
+
+// ArchiveFetcher downloads an article package to a local file without
+// extracting it.
+type ArchiveFetcher interface {
+	FetchArchive(url string, archivePath string) error
+}
+
+// Client makes every request the downloader sends. The base URLs, HTTP client
+// and archive fetcher can all be replaced, which is how the sync is pointed at
+// a fake server in tests.
+type Client struct {
+	// The start of the OA web service URL, ending in from=.
+	UpdateURLBase string
+	// The start of the OA web service URL for a single article, ending in id=.
+	RecordURLBase string
+	// The start of the efetch URL, ending in id=.
+	MetadataBaseLink string
+	// The start of the ID converter URL, ending in ids=.
+	PMCIDBaseLink string
+	// Where the full OA file list can be downloaded from.
+	FileListURL string
+	// The folder the File column of the OA file list is relative to. Links
+	// built from it look like the ones the OA web service hands out.
+	PackageBaseURL string
+
+	// Used for every request. NewClient sets one up that shares a single rate
+	// limiter between all requests.
+	HTTPClient *http.Client
+	// Used to download article packages. Defaults to fetching them with
+	// HTTPClient.
+	Fetcher ArchiveFetcher
+	// How failed requests are retried.
+	RetryPolicy retryPolicy
+
+	EmailAddress string
+	APIKey       string
+}
+
+// NewClient returns a Client for the real NCBI services, rate limited to the
+// budget allowed with or without an API key.
+func NewClient(emailAddress string, apiKey string) *Client {
+	limiter := newRateLimiter(requestsPerSecond(apiKey))
+	client := &Client{
+		UpdateURLBase:    defaultUpdateURLBase,
+		RecordURLBase:    defaultRecordURLBase,
+		MetadataBaseLink: defaultMetadataBaseLink,
+		PMCIDBaseLink:    defaultPMCIDBaseLink,
+		FileListURL:      defaultFileListURL,
+		PackageBaseURL:   defaultPackageBaseURL,
+		HTTPClient: &http.Client{
+			Transport: newLimitedTransport(limiter, http.DefaultTransport),
+			Timeout:   requestTimeout,
+		},
+		RetryPolicy:  defaultRetryPolicy,
+		EmailAddress: emailAddress,
+		APIKey:       apiKey,
+	}
+	client.Fetcher = &httpArchiveFetcher{client: client}
+	return client
+}
+
+// userInfo returns the query parameters that identify this tool to the
+// E-utilities services.
+func (client *Client) userInfo() string {
+	return buildUserInfo(client.EmailAddress, client.APIKey)
+}
+
+// httpArchiveFetcher downloads packages with the client's own HTTP client so
+// they count against the same rate limit as everything else.
+type httpArchiveFetcher struct {
+	client *Client
+}
+
+func (fetcher *httpArchiveFetcher) FetchArchive(url string, archivePath string) error {
+	return fetcher.client.fetchToFile(url, archivePath)
+}
+
+// downloadXML downloads the full OA file list into oafilesPath and returns
+// the path it was saved to.
+func (client *Client) downloadXML(oafilesPath string) (string, error) {
+	// Build the file path.
+	basePath := path.Join(oafilesPath, "oa_file_list_")
+	const baseEnd = ".csv"
+
+	filePath := basePath + time.Now().Format("20060102150405") + baseEnd
+
+	// Download the data to the file.
+	err := client.fetchToFile(client.FileListURL, filePath)
+	if err != nil {
+		os.Remove(filePath)
+		return "", err
+	}
+
+	return filePath, nil
+}
+
+// downloadUpdatePage downloads and parses a page of the OA web service. A
+// page that is not the service's XML, such as an HTML error page, or that
+// says the request was turned down, will not change if it is asked for
+// again, so it is a permanent error.
+func (client *Client) downloadUpdatePage(url string) (*databaseUpdate, error) {
+	updateXML, err := client.fetchURL(url)
+	if err != nil {
+		return nil, err
+	}
+	var update databaseUpdate
+	err = xml.Unmarshal(updateXML, &update)
+	if err != nil {
+		log.Print("issue unmarshalling the OA update page")
+		return nil, &permanentError{Err: err}
+	}
+	if update.Error.Code != "" {
+		return nil, &permanentError{Err: errors.New("the OA service turned down " + redactURL(url) + ": " + update.Error.Code + " " + strings.TrimSpace(update.Error.Message))}
+	}
+	return &update, nil
+}
+
+// downloadOARecords looks up the OA record of each PMCID, listing the formats
+// asked for by formatURL. PMCIDs that are not in the OA subset are returned
+// separately.
+func (client *Client) downloadOARecords(pmcids []string, formatURL string) ([]record, []string, error) {
+	foundRecords := []record{}
+	missingPMCIDs := []string{}
+	for _, pmcid := range pmcids {
+		updateXML, err := client.fetchURL(client.RecordURLBase + pmcid + formatURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		var update databaseUpdate
+		err = xml.Unmarshal(updateXML, &update)
+		if err != nil {
+			log.Print("issue unmarshalling OA record")
+			return nil, nil, &permanentError{Err: err}
+		}
+		if len(update.Records.RecordList) == 0 {
+			missingPMCIDs = append(missingPMCIDs, pmcid)
+			continue
+		}
+		foundRecords = append(foundRecords, update.Records.RecordList...)
+	}
+	return foundRecords, missingPMCIDs, nil
+}
+
+func (client *Client) fetchArticle(url string, archivePath string) error {
+	// Download the article package at url to archivePath without extracting
+	// it, so that a truncated download can be retried before anything is
+	// extracted.
+	os.MkdirAll(path.Dir(archivePath), 0655)
+	err := client.Fetcher.FetchArchive(url, archivePath)
+	if err != nil {
+		os.Remove(archivePath)
+		log.Print("Error downloading article. See error below:")
+		return err
+	}
+	return nil
+}
+
+func (client *Client) downloadMetaDataXML(url string) (*xml_definitions.PubmedArticleSet, error) {
+	// Download the data.
+	dataString, err := client.fetchURL(url)
+	if err != nil {
+		log.Print("Error reading the metadata file.")
+		return nil, err
+	}
+
+	// Parse the XML data.
+	pubMedMetadata := xml_definitions.PubmedArticleSet{}
+	err = xml.Unmarshal(dataString, &pubMedMetadata)
+	if err != nil {
+		//log.Print(pubMedMetadata)
+		log.Print(redactURL(url))
+		log.Print("issue unmarshalling xml metadata")
+		log.Print(err)
+		return nil, &permanentError{Err: err}
+	}
+	if pubMedMetadata.PubmedArticles == nil {
+		pubMedMetadata.PubmedArticles = &[]xml_definitions.PubmedArticle{}
+	}
+	//log.Print(pubMedMetadata)
+
+	return &pubMedMetadata, nil
+}
+
+func (client *Client) downloadIDXML(url string) (*xml_definitions.PCMIDSet, error) {
+	// Download the data.
+	dataString, err := client.fetchURL(url)
+	if err != nil {
+		log.Print("Error reading the metadata file.")
+		return nil, err
+	}
+
+	// Parse the XML data.
+	pubMedMetadata := xml_definitions.PCMIDSet{}
+	err = xml.Unmarshal(dataString, &pubMedMetadata)
+	if err != nil {
+		log.Print("issue unmarshalling id metadata")
+		log.Print(err)
+		return nil, &permanentError{Err: err}
+	}
+	//log.Print(pubMedMetadata)
+
+	return &pubMedMetadata, nil
+}
+
+// fetchURL downloads the body at url, retrying transient failures.
+func (client *Client) fetchURL(url string) ([]byte, error) {
+	var data []byte
+	err := withRetry(client.RetryPolicy, redactURL(url), func() error {
+		resp, err := client.HTTPClient.Get(url)
+		if err != nil {
+			return redactError(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return &statusError{URL: redactURL(url), StatusCode: resp.StatusCode}
+		}
+
+		data, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+	return data, err
+}
+
+// fetchToFile downloads the body at url into filePath, retrying transient
+// failures. A body shorter than the advertised length counts as truncated and
+// is retried.
+func (client *Client) fetchToFile(url string, filePath string) error {
+	return withRetry(client.RetryPolicy, redactURL(url), func() error {
+		resp, err := client.HTTPClient.Get(url)
+		if err != nil {
+			return redactError(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return &statusError{URL: redactURL(url), StatusCode: resp.StatusCode}
+		}
+
+		outFile, err := os.Create(filePath)
+		if err != nil {
+			return &permanentError{Err: err}
+		}
+		defer outFile.Close()
+
+		written, err := io.Copy(outFile, resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.ContentLength >= 0 && written != resp.ContentLength {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+}
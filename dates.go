@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"./json_definitions"
+	"./xml_definitions"
+)
+
+// The month names and abbreviations PubMed uses in PubDate and MedlineDate,
+// matched on their first three letters.
+var monthNumbers = map[string]string{
+	"jan": "01", "feb": "02", "mar": "03", "apr": "04",
+	"may": "05", "jun": "06", "jul": "07", "aug": "08",
+	"sep": "09", "oct": "10", "nov": "11", "dec": "12",
+}
+
+// The History statuses of a PubMed record in the order they are preferred as
+// the date of an article. The dates it was published come first, then the
+// dates PubMed first listed it. Any other status is only used if there is
+// nothing better.
+var historyStatusPreference = []string{"epublish", "ppublish", "aheadofprint", "pubmed", "entrez", "medline"}
+
+// resolvePubmedDate picks the date of an article from its PubMed record.
+// DateCompleted is missing from citations that are still being indexed or
+// were supplied by the publisher, so the date falls back to the electronic
+// publication date, the date of the journal issue and finally the History of
+// the record. The date is normalised and its Source says where it came from.
+// A record without any usable date gives an empty date.
+func resolvePubmedDate(pubmedArticle *xml_definitions.PubmedArticle) json_definitions.Date {
+	citation := pubmedArticle.MedlineCitation
+	completed := citation.DateCompleted
+	date, found := normaliseDate("date-completed", completed.Year, completed.Month, completed.Day)
+	if found {
+		return date
+	}
+
+	articleDate := citation.Article.ArticleDate
+	date, found = normaliseDate("article-date", articleDate.Year, articleDate.Month, articleDate.Day)
+	if found {
+		return date
+	}
+
+	pubDate := citation.Article.Journal.JournalIssue.PubDate
+	date, found = normaliseDate("pub-date", pubDate.Year, pubDate.Month, pubDate.Day)
+	if found {
+		return date
+	}
+	date, found = parseMedlineDate(pubDate.MedlineDate)
+	if found {
+		return date
+	}
+
+	history := pubmedArticle.PubmedData.History
+	for _, preferred := range historyStatusPreference {
+		for _, historyDate := range history {
+			if historyDate.PubStatus != preferred {
+				continue
+			}
+			date, found = normaliseDate("history:"+historyDate.PubStatus, historyDate.Year, historyDate.Month, historyDate.Day)
+			if found {
+				return date
+			}
+		}
+	}
+	for _, historyDate := range history {
+		date, found = normaliseDate("history:"+historyDate.PubStatus, historyDate.Year, historyDate.Month, historyDate.Day)
+		if found {
+			return date
+		}
+	}
+	return json_definitions.Date{}
+}
+
+// parseMedlineDate reads the free text date PubMed gives instead of a Year
+// when an issue does not fall on a single month, such as "1998 Dec-1999 Jan"
+// or "2000 Spring". The start of the range is used, and as much of it as can
+// be read is kept.
+func parseMedlineDate(medlineDate string) (json_definitions.Date, bool) {
+	fields := strings.FieldsFunc(medlineDate, func(r rune) bool {
+		return r == ' ' || r == '-' || r == '/' || r == ','
+	})
+	if len(fields) == 0 {
+		return json_definitions.Date{}, false
+	}
+	year, month, day := fields[0], "", ""
+	if len(fields) > 1 && normaliseMonth(fields[1]) != "" {
+		month = fields[1]
+		if len(fields) > 2 && normaliseDay(fields[2]) != "" {
+			day = fields[2]
+		}
+	}
+	return normaliseDate("medline-date", year, month, day)
+}
+
+// normaliseDate builds a metadata date out of a year, month and day in any of
+// the forms PubMed and JATS use. The year is required. A month or day that
+// cannot be read is left out, along with anything finer than it.
+func normaliseDate(source string, year string, month string, day string) (json_definitions.Date, bool) {
+	year = strings.TrimSpace(year)
+	yearNumber, err := strconv.Atoi(year)
+	if err != nil || len(year) != 4 || yearNumber < 1000 {
+		return json_definitions.Date{}, false
+	}
+	date := json_definitions.Date{
+		Year:   year,
+		ISO:    year,
+		Source: source,
+	}
+	date.Month = normaliseMonth(month)
+	if date.Month == "" {
+		return date, true
+	}
+	date.ISO += "-" + date.Month
+	date.Day = normaliseDay(day)
+	if date.Day != "" {
+		date.ISO += "-" + date.Day
+	}
+	return date, true
+}
+
+// normaliseMonth turns a month such as "3", "03", "Mar" or "March" into its
+// two digit number, or an empty string if it is not a month.
+func normaliseMonth(month string) string {
+	month = strings.TrimSpace(month)
+	number, err := strconv.Atoi(month)
+	if err == nil {
+		if number < 1 || number > 12 {
+			return ""
+		}
+		return padDatePart(strconv.Itoa(number))
+	}
+	if len(month) < 3 {
+		return ""
+	}
+	return monthNumbers[strings.ToLower(month[:3])]
+}
+
+// normaliseDay turns a day such as "4" into its two digit form, or an empty
+// string if it is not a day.
+func normaliseDay(day string) string {
+	day = strings.TrimSpace(day)
+	number, err := strconv.Atoi(day)
+	if err != nil || number < 1 || number > 31 {
+		return ""
+	}
+	return padDatePart(strconv.Itoa(number))
+}
+
+// listingDate gives the publication date of an article in the YYYYMMDD form
+// of the date column of the article listing. A month or day that is not
+// known is written as 00, so every date has the same length and the column
+// sorts and parses the same way whatever the date was built from. An article
+// without a date gives an empty string.
+func listingDate(date json_definitions.Date) string {
+	if date.Year == "" {
+		return ""
+	}
+	month, day := "00", "00"
+	if date.Month != "" {
+		month = date.Month
+		if date.Day != "" {
+			day = date.Day
+		}
+	}
+	return date.Year + month + day
+}
+
+// padDatePart turns a day or month such as "3" into the two digit form PubMed
+// uses.
+func padDatePart(part string) string {
+	part = strings.TrimSpace(part)
+	if len(part) == 1 {
+		return "0" + part
+	}
+	return part
+}
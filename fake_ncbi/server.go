@@ -0,0 +1,560 @@
+// Package fake_ncbi is an in-process stand-in for the NCBI services used by
+// the downloader. It serves the OA web service, the ID converter, efetch and
+// article packages from a directory of fixtures so the whole sync can be run
+// without touching the network.
+//
+// The fixtures directory holds:
+//
+//	records.json        the OA records, see Record
+//	idconv.json         the ID converter answers, see IDRecord
+//	efetch/<PMID>.xml   one <PubmedArticle> element per PMID
+//	packages/<PMCID>/   the files that make up each article package
+//	pdfs/<PMCID>.pdf    the PDF of each article offered as one
+package fake_ncbi
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The paths the fake serves each service on. They match the real services so
+// the links it hands out look like the real ones.
+const updatePath = "/pmc/utils/oa/oa.fcgi"
+const idconvPath = "/pmc/utils/idconv/v1.0/"
+const efetchPath = "/entrez/eutils/efetch.fcgi"
+const packagePath = "/pub/pmc/oa_package/"
+const pdfPath = "/pub/pmc/oa_pdf/"
+const fileListPath = "/pub/pmc/oa_file_list.csv"
+
+// The number of records returned on each page of the OA service when
+// PageSize is not set.
+const defaultPageSize = 2
+
+// Record is a single entry in records.json.
+type Record struct {
+	PMCID    string `json:"pmcid"`
+	Citation string `json:"citation"`
+	License  string `json:"license"`
+	// In the same "2006-01-02 15:04:05" form the OA service uses.
+	Updated string `json:"updated"`
+	// The two hashed directory names the package is stored under, such as
+	// "08/e0".
+	Hash string `json:"hash"`
+	// The formats the article is offered in, "tgz" and "pdf". Empty means
+	// only tgz.
+	Formats []string `json:"formats"`
+}
+
+// offers reports whether the record is offered in format.
+func (record Record) offers(format string) bool {
+	if len(record.Formats) == 0 {
+		return format == "tgz"
+	}
+	for _, offered := range record.Formats {
+		if offered == format {
+			return true
+		}
+	}
+	return false
+}
+
+// IDRecord is a single entry in idconv.json. PMID and DOI may be empty.
+type IDRecord struct {
+	PMCID string `json:"pmcid"`
+	PMID  string `json:"pmid"`
+	DOI   string `json:"doi"`
+}
+
+// Server is a running fake. The embedded httptest.Server gives access to the
+// URL, a matching http.Client and Close.
+type Server struct {
+	*httptest.Server
+
+	// The number of OA records on each page. Set it before making requests.
+	PageSize int
+	// ReverseAnswers makes the ID converter and efetch answer in the reverse
+	// of the order they were asked, which the real services are free to do.
+	ReverseAnswers bool
+	// TooManyRequests makes that many of the next requests fail with 429 Too
+	// Many Requests, as the real services do when a client goes over its
+	// rate limit. RetryAfter is sent as their Retry-After header if set.
+	// Rejected requests are counted like any other.
+	TooManyRequests int
+	RetryAfter      string
+
+	fixturesPath string
+	records      []Record
+	idRecords    map[string]IDRecord
+
+	mu          sync.Mutex
+	requests    map[string]int
+	updateFroms []string
+}
+
+// NewServer loads the fixtures under fixturesPath and starts serving them.
+func NewServer(fixturesPath string) (*Server, error) {
+	server := &Server{
+		PageSize:     defaultPageSize,
+		fixturesPath: fixturesPath,
+		idRecords:    make(map[string]IDRecord),
+		requests:     make(map[string]int),
+	}
+
+	err := readJSONFixture(path.Join(fixturesPath, "records.json"), &server.records)
+	if err != nil {
+		return nil, err
+	}
+	var idRecords []IDRecord
+	err = readJSONFixture(path.Join(fixturesPath, "idconv.json"), &idRecords)
+	if err != nil {
+		return nil, err
+	}
+	for _, idRecord := range idRecords {
+		server.idRecords[idRecord.PMCID] = idRecord
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(updatePath, server.handleUpdate)
+	mux.HandleFunc(idconvPath, server.handleIDConv)
+	mux.HandleFunc(efetchPath, server.handleEFetch)
+	mux.HandleFunc(packagePath, server.handlePackage)
+	mux.HandleFunc(pdfPath, server.handlePDF)
+	mux.HandleFunc(fileListPath, server.handleFileList)
+	server.Server = httptest.NewServer(server.count(mux))
+	return server, nil
+}
+
+func readJSONFixture(fixturePath string, value interface{}) error {
+	byteArray, err := ioutil.ReadFile(fixturePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(byteArray, value)
+}
+
+// UpdateURLBase is the fake's equivalent of the OA service URL, ending in
+// from=.
+func (server *Server) UpdateURLBase() string {
+	return server.URL + updatePath + "?from="
+}
+
+// PMCIDBaseLink is the fake's equivalent of the ID converter URL, ending in
+// ids=.
+func (server *Server) PMCIDBaseLink() string {
+	return server.URL + idconvPath + "?versions=no&idtype=pmcid&ids="
+}
+
+// RecordURLBase is the fake's equivalent of the OA service URL for a single
+// article, ending in id=.
+func (server *Server) RecordURLBase() string {
+	return server.URL + updatePath + "?id="
+}
+
+// MetadataBaseLink is the fake's equivalent of the efetch URL, ending in id=.
+func (server *Server) MetadataBaseLink() string {
+	return server.URL + efetchPath + "?db=pubmed&retmode=XML&id="
+}
+
+// FileListURL is the fake's equivalent of the OA file list URL.
+func (server *Server) FileListURL() string {
+	return server.URL + fileListPath
+}
+
+// PackageBaseURL is the fake's equivalent of the FTP folder the File column
+// of the OA file list is relative to.
+func (server *Server) PackageBaseURL() string {
+	return "ftp://" + strings.TrimPrefix(server.URL, "http://") + "/pub/pmc/"
+}
+
+// UpdateFroms returns the from= of every request made to the OA service for
+// a range of records, in the order they were made.
+func (server *Server) UpdateFroms() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]string{}, server.updateFroms...)
+}
+
+// Requests returns how many requests have been made to the given path, for
+// example "/pmc/utils/oa/oa.fcgi".
+func (server *Server) Requests(requestPath string) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.requests[requestPath]
+}
+
+func (server *Server) count(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		server.requests[r.URL.Path]++
+		rejected := server.TooManyRequests > 0
+		if rejected {
+			server.TooManyRequests--
+		}
+		server.mu.Unlock()
+		if rejected {
+			if server.RetryAfter != "" {
+				w.Header().Set("Retry-After", server.RetryAfter)
+			}
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type oaLink struct {
+	Format  string `xml:"format,attr"`
+	Updated string `xml:"updated,attr"`
+	Href    string `xml:"href,attr"`
+}
+
+type oaRecord struct {
+	ID       string   `xml:"id,attr"`
+	Citation string   `xml:"citation,attr"`
+	License  string   `xml:"license,attr,omitempty"`
+	Links    []oaLink `xml:"link"`
+}
+
+type oaResumptionLink struct {
+	Token string `xml:"token,attr"`
+	Href  string `xml:"href,attr"`
+}
+
+type oaRecords struct {
+	ReturnedCount int               `xml:"returned-count,attr"`
+	TotalCount    int               `xml:"total-count,attr"`
+	Resumption    *oaResumptionLink `xml:"resumption>link"`
+	Records       []oaRecord        `xml:"record"`
+}
+
+type oaRequest struct {
+	From string `xml:"from,attr,omitempty"`
+	Data string `xml:",chardata"`
+}
+
+type oaResponse struct {
+	XMLName      xml.Name  `xml:"OA"`
+	ResponseDate string    `xml:"responseDate"`
+	Request      oaRequest `xml:"request"`
+	Records      oaRecords `xml:"records"`
+}
+
+// UpdateRecord gives the record of pmcid a new update time, as if a new
+// version of the article had been published. Call it between requests.
+func (server *Server) UpdateRecord(pmcid string, updated string) bool {
+	for i := range server.records {
+		if server.records[i].PMCID == pmcid {
+			server.records[i].Updated = updated
+			return true
+		}
+	}
+	return false
+}
+
+// handleUpdate serves the OA web service. It supports from=, until=, id=,
+// format= and a resumption token, which is simply the offset of the first
+// record on the page. Without format= every format of a record is listed.
+func (server *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from := query.Get("from")
+	until := query.Get("until")
+	id := query.Get("id")
+	format := query.Get("format")
+	if id == "" && query.Get("resumptionToken") == "" {
+		server.mu.Lock()
+		server.updateFroms = append(server.updateFroms, from)
+		server.mu.Unlock()
+	}
+
+	matching := []Record{}
+	for _, record := range server.records {
+		if id != "" && record.PMCID != id {
+			continue
+		}
+		if record.Updated < from || (until != "" && record.Updated > until) {
+			continue
+		}
+		if format != "" && !record.offers(format) {
+			continue
+		}
+		matching = append(matching, record)
+	}
+
+	offset := 0
+	if token := query.Get("resumptionToken"); token != "" {
+		var err error
+		offset, err = strconv.Atoi(token)
+		if err != nil || offset < 0 || offset > len(matching) {
+			http.Error(w, "bad resumption token", http.StatusBadRequest)
+			return
+		}
+	}
+	pageSize := server.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	end := offset + pageSize
+	if end > len(matching) {
+		end = len(matching)
+	}
+
+	response := oaResponse{
+		ResponseDate: time.Now().Format("2006-01-02 15:04:05"),
+		Request: oaRequest{
+			From: from,
+			Data: server.URL + r.URL.RequestURI(),
+		},
+		Records: oaRecords{
+			ReturnedCount: end - offset,
+			TotalCount:    len(matching),
+		},
+	}
+	for _, record := range matching[offset:end] {
+		links := []oaLink{}
+		if (format == "" || format == "tgz") && record.offers("tgz") {
+			links = append(links, oaLink{
+				Format:  "tgz",
+				Updated: record.Updated,
+				Href:    "ftp://" + r.Host + packagePath + record.Hash + "/" + record.PMCID + ".tar.gz",
+			})
+		}
+		if (format == "" || format == "pdf") && record.offers("pdf") {
+			links = append(links, oaLink{
+				Format:  "pdf",
+				Updated: record.Updated,
+				Href:    "ftp://" + r.Host + pdfPath + record.Hash + "/" + record.PMCID + ".pdf",
+			})
+		}
+		response.Records.Records = append(response.Records.Records, oaRecord{
+			ID:       record.PMCID,
+			Citation: record.Citation,
+			License:  record.License,
+			Links:    links,
+		})
+	}
+	if end < len(matching) {
+		next := query
+		next.Set("resumptionToken", strconv.Itoa(end))
+		response.Records.Resumption = &oaResumptionLink{
+			Token: strconv.Itoa(end),
+			Href:  server.URL + updatePath + "?" + next.Encode(),
+		}
+	}
+
+	writeXML(w, response)
+}
+
+// handleFileList serves oa_file_list.csv with a row for every record offered
+// as a tgz package.
+func (server *Server) handleFileList(w http.ResponseWriter, r *http.Request) {
+	var body bytes.Buffer
+	csvWriter := csv.NewWriter(&body)
+	csvWriter.Write([]string{"File", "Article Citation", "Accession ID", "Last Updated (YYYY-MM-DD HH:MM:SS)", "PMID", "License"})
+	for _, record := range server.records {
+		if !record.offers("tgz") {
+			continue
+		}
+		csvWriter.Write([]string{
+			"oa_package/" + record.Hash + "/" + record.PMCID + ".tar.gz",
+			record.Citation,
+			record.PMCID,
+			record.Updated,
+			server.idRecords[record.PMCID].PMID,
+			record.License,
+		})
+	}
+	csvWriter.Flush()
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Write(body.Bytes())
+}
+
+type idconvRecord struct {
+	RequestedID string `xml:"requested-id,attr"`
+	PMCID       string `xml:"pmcid,attr,omitempty"`
+	PMID        string `xml:"pmid,attr,omitempty"`
+	DOI         string `xml:"doi,attr,omitempty"`
+	Status      string `xml:"status,attr,omitempty"`
+	ErrMsg      string `xml:"errmsg,attr,omitempty"`
+}
+
+type idconvResponse struct {
+	XMLName xml.Name       `xml:"pmcids"`
+	Status  string         `xml:"status,attr"`
+	Records []idconvRecord `xml:"record"`
+}
+
+// handleIDConv serves the ID converter, answering in the order the IDs were
+// asked for like the real service unless ReverseAnswers is set.
+func (server *Server) handleIDConv(w http.ResponseWriter, r *http.Request) {
+	response := idconvResponse{Status: "ok"}
+	for _, requestedID := range server.answerOrder(splitIDs(r.URL.Query().Get("ids"))) {
+		idRecord, found := server.idRecords[requestedID]
+		if !found {
+			response.Records = append(response.Records, idconvRecord{
+				RequestedID: requestedID,
+				Status:      "error",
+				ErrMsg:      "invalid article id",
+			})
+			continue
+		}
+		response.Records = append(response.Records, idconvRecord{
+			RequestedID: requestedID,
+			PMCID:       idRecord.PMCID,
+			PMID:        idRecord.PMID,
+			DOI:         idRecord.DOI,
+		})
+	}
+	writeXML(w, response)
+}
+
+// answerOrder returns the IDs in the order they should be answered in.
+func (server *Server) answerOrder(ids []string) []string {
+	if !server.ReverseAnswers {
+		return ids
+	}
+	reversed := make([]string, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		reversed = append(reversed, ids[i])
+	}
+	return reversed
+}
+
+// handleEFetch serves PubMed records by joining the efetch fixtures for the
+// requested PMIDs. PMIDs without a fixture are left out.
+func (server *Server) handleEFetch(w http.ResponseWriter, r *http.Request) {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	body.WriteString("<PubmedArticleSet>\n")
+	for _, pmid := range server.answerOrder(splitIDs(r.URL.Query().Get("id"))) {
+		article, err := ioutil.ReadFile(path.Join(server.fixturesPath, "efetch", pmid+".xml"))
+		if err != nil {
+			continue
+		}
+		body.Write(article)
+		body.WriteString("\n")
+	}
+	body.WriteString("</PubmedArticleSet>\n")
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(body.Bytes())
+}
+
+// handlePackage serves an article package, building the tar.gz from the
+// files under packages/<PMCID>.
+func (server *Server) handlePackage(w http.ResponseWriter, r *http.Request) {
+	pmcid := strings.TrimSuffix(path.Base(r.URL.Path), ".tar.gz")
+	packageDir := filepath.Join(server.fixturesPath, "packages", pmcid)
+	archive, err := buildPackage(packageDir, pmcid)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-gzip")
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.Write(archive)
+}
+
+// handlePDF serves the PDF of an article from pdfs/<PMCID>.pdf.
+func (server *Server) handlePDF(w http.ResponseWriter, r *http.Request) {
+	pmcid := strings.TrimSuffix(path.Base(r.URL.Path), ".pdf")
+	contents, err := ioutil.ReadFile(filepath.Join(server.fixturesPath, "pdfs", pmcid+".pdf"))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+	w.Write(contents)
+}
+
+// buildPackage tars and gzips packageDir with every file placed under a
+// folder named after the article, like the real packages.
+func buildPackage(packageDir string, pmcid string) ([]byte, error) {
+	files, err := ioutil.ReadDir(packageDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var archive bytes.Buffer
+	gzipWriter := gzip.NewWriter(&archive)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(packageDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		err = tarWriter.WriteHeader(&tar.Header{
+			Name:    pmcid + "/" + file.Name(),
+			Mode:    0644,
+			Size:    int64(len(contents)),
+			ModTime: file.ModTime(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = tarWriter.Write(contents)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tarWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return archive.Bytes(), nil
+}
+
+func splitIDs(ids string) []string {
+	split := []string{}
+	for _, id := range strings.Split(ids, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			split = append(split, id)
+		}
+	}
+	return split
+}
+
+func writeXML(w http.ResponseWriter, value interface{}) {
+	output, err := xml.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(output)
+}
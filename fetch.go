@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+)
+
+// fetchArticles downloads the given articles into the corpus whatever an
+// earlier run made of them. Articles that failed before are tried again, and
+// the counts of the fetch are kept out of the sync counts in runConfig.
+func (client *Client) fetchArticles(target *corpus, runConfig *config, pmcids []string, concurrency int, dryRun bool) error {
+	policy, err := parseFormatPolicy(runConfig.Formats)
+	if err != nil {
+		return err
+	}
+	records, missingPMCIDs, err := client.downloadOARecords(pmcids, policy.formatParameter())
+	if err != nil {
+		return err
+	}
+	for _, pmcid := range missingPMCIDs {
+		log.Print(pmcid + " is not in the open access subset.")
+	}
+	if dryRun {
+		printRecordDownloads(records, policy)
+		return nil
+	}
+	if len(records) == 0 {
+		return errors.New("none of the given articles are in the open access subset")
+	}
+
+	// Fetching an article by name is how a failed one is tried again by
+	// hand, so it must not be skipped as finished.
+	err = target.Journal.RestartFailed(records, "fetch")
+	if err != nil {
+		return err
+	}
+
+	fetchConfig := *runConfig
+	fetchConfig.ArticlesProcessed = 0
+	fetchConfig.BadArticles = 0
+	err = client.processRecords(records, target, &fetchConfig, concurrency)
+	if err != nil {
+		return err
+	}
+	log.Print("Fetch saved " + strconv.Itoa(fetchConfig.ArticlesProcessed) + " articles, " + strconv.Itoa(fetchConfig.BadArticles) + " bad.")
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// formatPolicy decides which of the formats an article is offered in are
+// downloaded. The OA service offers most articles as a tgz package holding
+// the NXML, figures and usually a PDF, and some older ones only as a PDF.
+type formatPolicy string
+
+const (
+	// Only tgz packages. Articles only offered as a PDF are skipped.
+	formatTgz formatPolicy = "tgz"
+	// Only PDFs. Articles only offered as a package are skipped.
+	formatPDF formatPolicy = "pdf"
+	// Every format the article is offered in.
+	formatBoth formatPolicy = "both"
+	// The tgz package if there is one, otherwise the PDF.
+	formatPreferTgz formatPolicy = "prefer-tgz"
+)
+
+// parseFormatPolicy reads the formats value from config.json. An empty value
+// keeps the original behaviour of only downloading tgz packages.
+func parseFormatPolicy(value string) (formatPolicy, error) {
+	switch formatPolicy(value) {
+	case "":
+		return formatTgz, nil
+	case formatTgz, formatPDF, formatBoth, formatPreferTgz:
+		return formatPolicy(value), nil
+	}
+	return "", errors.New("formats must be one of tgz, pdf, both or prefer-tgz, not " + value)
+}
+
+// formatParameter returns the format= parameter to send to the OA service.
+// Without one the service lists every format of each article.
+func (policy formatPolicy) formatParameter() string {
+	switch policy {
+	case formatTgz:
+		return "&format=tgz"
+	case formatPDF:
+		return "&format=pdf"
+	}
+	return ""
+}
+
+// packagesOnly reports whether the tgz packages described by the OA file
+// list are all the policy can want. Any other policy has to look articles up
+// in the OA web service to find their PDFs.
+func (policy formatPolicy) packagesOnly() bool {
+	return policy == formatTgz || policy == formatPreferTgz
+}
+
+// selectLinks returns the links of a record that should be downloaded, with
+// any tgz package first. An empty result means the article is skipped.
+func (policy formatPolicy) selectLinks(links []recordLink) []recordLink {
+	var tgzLink, pdfLink *recordLink
+	for i := range links {
+		switch links[i].Format {
+		case "tgz":
+			if tgzLink == nil {
+				tgzLink = &links[i]
+			}
+		case "pdf":
+			if pdfLink == nil {
+				pdfLink = &links[i]
+			}
+		}
+	}
+
+	selected := []recordLink{}
+	switch policy {
+	case formatTgz:
+		if tgzLink != nil {
+			selected = append(selected, *tgzLink)
+		}
+	case formatPDF:
+		if pdfLink != nil {
+			selected = append(selected, *pdfLink)
+		}
+	case formatBoth:
+		if tgzLink != nil {
+			selected = append(selected, *tgzLink)
+		}
+		if pdfLink != nil {
+			selected = append(selected, *pdfLink)
+		}
+	case formatPreferTgz:
+		if tgzLink != nil {
+			selected = append(selected, *tgzLink)
+		} else if pdfLink != nil {
+			selected = append(selected, *pdfLink)
+		}
+	}
+	return selected
+}
+
+// selectFormats picks the downloads of a record according to the policy. The
+// first of them becomes the record's Link, which the article is tracked by.
+// It reports false if there is nothing to download.
+func (policy formatPolicy) selectFormats(currentRecord *record) bool {
+	currentRecord.Downloads = policy.selectLinks(currentRecord.Links)
+	if len(currentRecord.Downloads) == 0 {
+		return false
+	}
+	currentRecord.Link = currentRecord.Downloads[0]
+	return true
+}
+
+// linkHTTPURL turns the ftp:// link handed out by the OA service into the
+// http:// URL of the same file. A link without a scheme and host, which the
+// service should never hand out, is an error.
+func linkHTTPURL(href string) (string, error) {
+	articleList := strings.SplitN(href, "/", 3)
+	if len(articleList) < 3 || !strings.HasSuffix(articleList[0], ":") || articleList[1] != "" || articleList[2] == "" {
+		return "", errors.New("the link " + href + " is not an absolute URL")
+	}
+	return "http://" + articleList[2], nil
+}
+
+// linkHashPath returns the two hashed folder names a link is stored under,
+// such as "08/e0" for ftp://host/pub/pmc/oa_package/08/e0/PMC13900.tar.gz.
+// A link with a shorter path is an error.
+func linkHashPath(href string) (string, error) {
+	articleList := strings.SplitN(href, "/", 3)
+	if len(articleList) < 3 {
+		return "", errors.New("the link " + href + " is not an absolute URL")
+	}
+	articleListHashes := strings.Split(articleList[2], "/")
+	if len(articleListHashes) < 7 || articleListHashes[4] == "" || articleListHashes[5] == "" {
+		return "", errors.New("the link " + href + " is not in a pair of hashed folders")
+	}
+	return articleListHashes[4] + "/" + articleListHashes[5], nil
+}
+
+// checkLinks makes sure every download of a record can be turned into a URL
+// and the folders it is stored under, so a bad link from the service is
+// caught before anything is downloaded.
+func checkLinks(currentRecord record) error {
+	for _, link := range currentRecord.Downloads {
+		_, err := linkHTTPURL(link.Href)
+		if err == nil {
+			_, err = linkHashPath(link.Href)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkFileName returns the name of the file a link points at.
+func linkFileName(href string) string {
+	return path.Base(href)
+}
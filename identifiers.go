@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"./xml_definitions"
+)
+
+// The identifiers an article must have when config.json does not say
+// otherwise. Every article in the OA subset has a PMCID, so that is never
+// listed, and articles without a PMID get their metadata from their own
+// NXML instead of PubMed.
+var defaultRequiredIdentifiers = []string{}
+
+// identifierPolicy says which identifiers an article must have to be kept.
+// Articles missing one of them are sent to the bad listing.
+type identifierPolicy struct {
+	RequirePMID bool
+	RequireDOI  bool
+}
+
+// parseIdentifierPolicy reads the required_identifiers value from
+// config.json. A missing value uses defaultRequiredIdentifiers and an empty
+// list requires nothing.
+func parseIdentifierPolicy(required []string) (identifierPolicy, error) {
+	if required == nil {
+		required = defaultRequiredIdentifiers
+	}
+	policy := identifierPolicy{}
+	for _, identifier := range required {
+		switch strings.ToLower(strings.TrimSpace(identifier)) {
+		case "pmid":
+			policy.RequirePMID = true
+		case "doi":
+			policy.RequireDOI = true
+		case "pmcid", "":
+		default:
+			return policy, errors.New("required_identifiers can only hold pmid and doi, not " + identifier)
+		}
+	}
+	return policy, nil
+}
+
+// missingIdentifier returns the bad listing reason for an article without
+// one of the required identifiers, or an empty string if it has them all.
+func (policy identifierPolicy) missingIdentifier(idRecord xml_definitions.Record) string {
+	if policy.RequirePMID && idRecord.PMID == "" {
+		return "PMIDError"
+	}
+	if policy.RequireDOI && idRecord.DOI == "" {
+		return "DOIError"
+	}
+	return ""
+}
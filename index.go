@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The buckets of the article index. Articles are stored under their PMID, or
+// their PMCID if they do not have one, and the other two buckets map a PMCID
+// or a lower case DOI to that key.
+var (
+	articlesBucket = []byte("articles")
+	pmcidBucket    = []byte("pmcid")
+	doiBucket      = []byte("doi")
+)
+
+// How long to wait for another run to let go of the index before giving up.
+const indexLockTimeout = 10 * time.Second
+
+// indexEntry is everything the index knows about a single article. It holds
+// the same values as a row of the old article listing.
+type indexEntry struct {
+	PMID  string `json:"pmid,omitempty"`
+	PMCID string `json:"pmcid"`
+	DOI   string `json:"doi,omitempty"`
+	// The two hashed folders the article and its metadata are stored under.
+	Path string `json:"path"`
+	// The publication date as YYYYMMDD, with 00 for a month or day that is
+	// not known, or empty if the article has no date. See listingDate.
+	Date string `json:"date"`
+	// The OA service update time of the stored version, and of the version
+	// it replaced. Articles imported from the old listing have neither.
+	Updated         string `json:"updated,omitempty"`
+	PreviousUpdated string `json:"previous_updated,omitempty"`
+	// The number of versions of the article that have been stored, counting
+	// from 1.
+	Revision int `json:"revision"`
+	// The license the OA service gives for the article, such as CC BY.
+	License string `json:"license,omitempty"`
+}
+
+// Key is the PMID of the article, or its PMCID if it does not have one.
+func (entry indexEntry) Key() string {
+	if entry.PMID == "" {
+		return entry.PMCID
+	}
+	return entry.PMID
+}
+
+// listingFields returns the columns of the article listing for the entry:
+// key, hash path, date, PMCID and DOI. The update time and license are only
+// kept in the index.
+func (entry indexEntry) listingFields() []string {
+	return []string{entry.Key(), entry.Path, entry.Date, entry.PMCID, entry.DOI}
+}
+
+// articleIndex is the embedded database every saved article is recorded in.
+// Unlike the article listing it holds a single entry per article however many
+// times the article is updated, and can look articles up by PMID, PMCID or
+// DOI without reading everything.
+type articleIndex struct {
+	db *bolt.DB
+}
+
+// openIndex opens the index at indexPath, creating it if needed. A read only
+// index can be shared with other readers, but not with a run that is writing
+// to it.
+func openIndex(indexPath string, readOnly bool) (*articleIndex, error) {
+	db, err := bolt.Open(indexPath, 0644, &bolt.Options{Timeout: indexLockTimeout, ReadOnly: readOnly})
+	if err != nil {
+		log.Print("Issue opening the article index. Is another run using it?")
+		return nil, err
+	}
+	index := &articleIndex{db: db}
+	if readOnly {
+		return index, nil
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{articlesBucket, pmcidBucket, doiBucket} {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Print("issue creating the article index buckets")
+		db.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+func (index *articleIndex) Close() error {
+	return index.db.Close()
+}
+
+// indexConflictError is returned when an article would be stored under a key
+// that already belongs to a different article, as happens when PubMed links
+// two PMCIDs to the same PMID.
+type indexConflictError struct {
+	Key           string
+	PMCID         string
+	ExistingPMCID string
+}
+
+func (err *indexConflictError) Error() string {
+	return err.PMCID + " cannot be indexed under " + err.Key + ", which already belongs to " + err.ExistingPMCID
+}
+
+// Put records an article, replacing whatever the index held for it before,
+// and returns the entry it replaced or nil if the article is new. A new
+// version of an article gets the next revision and keeps the update time of
+// the one it replaced. An article that was stored under its PMCID and has
+// since been given a PMID is moved to the new key. An article whose key
+// already belongs to another article is refused with an indexConflictError
+// and the index is left as it was.
+func (index *articleIndex) Put(entry indexEntry) (*indexEntry, error) {
+	var previous *indexEntry
+	err := index.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		previous, err = putTx(tx, entry)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// putTx does the work of Put inside an existing transaction, so that many
+// articles can be recorded with a single commit. A conflict is found before
+// anything is written, so the transaction can carry on without that article.
+func putTx(tx *bolt.Tx, entry indexEntry) (*indexEntry, error) {
+	if entry.PMCID == "" {
+		return nil, errors.New("cannot index an article without a PMCID")
+	}
+	key := []byte(entry.Key())
+	articles := tx.Bucket(articlesBucket)
+	pmcids := tx.Bucket(pmcidBucket)
+	dois := tx.Bucket(doiBucket)
+
+	// The old entries of this article are the one under its key and, if it
+	// has just been given a PMID, the one under its PMCID. They are all read
+	// before anything is changed so that a conflict leaves the index alone.
+	staleKeys := [][]byte{key}
+	oldKey := pmcids.Get([]byte(entry.PMCID))
+	if oldKey != nil && string(oldKey) != string(key) {
+		staleKeys = append(staleKeys, append([]byte{}, oldKey...))
+	}
+	var previous *indexEntry
+	staleEntries := make(map[string]indexEntry)
+	for _, staleKey := range staleKeys {
+		staleValue := articles.Get(staleKey)
+		if staleValue == nil {
+			continue
+		}
+		var stale indexEntry
+		err := json.Unmarshal(staleValue, &stale)
+		if err != nil {
+			// An entry that cannot be read is simply replaced.
+			log.Print("Replacing unreadable index entry " + string(staleKey))
+			staleEntries[string(staleKey)] = indexEntry{}
+			continue
+		}
+		if stale.PMCID != entry.PMCID {
+			return nil, &indexConflictError{Key: string(staleKey), PMCID: entry.PMCID, ExistingPMCID: stale.PMCID}
+		}
+		previous = &stale
+		staleEntries[string(staleKey)] = stale
+	}
+
+	for staleKey, stale := range staleEntries {
+		if stale.PMCID != "" {
+			pmcids.Delete([]byte(stale.PMCID))
+		}
+		// Only drop the DOI if it still points here, since another article
+		// may have been given the same DOI since.
+		if stale.DOI != "" && string(dois.Get([]byte(strings.ToLower(stale.DOI)))) == staleKey {
+			dois.Delete([]byte(strings.ToLower(stale.DOI)))
+		}
+		err := articles.Delete([]byte(staleKey))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entry.Revision = 1
+	if previous != nil {
+		entry.Revision = previous.Revision
+		entry.PreviousUpdated = previous.PreviousUpdated
+		if entry.Revision < 1 {
+			entry.Revision = 1
+		}
+		if entry.Updated != previous.Updated {
+			entry.Revision++
+			entry.PreviousUpdated = previous.Updated
+		}
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	err = articles.Put(key, value)
+	if err != nil {
+		return nil, err
+	}
+	err = pmcids.Put([]byte(entry.PMCID), key)
+	if err != nil {
+		return nil, err
+	}
+	if entry.DOI != "" {
+		err = dois.Put([]byte(strings.ToLower(entry.DOI)), key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return previous, nil
+}
+
+// Get returns the article stored under key, a PMID or the PMCID of an article
+// without one, and whether there is one.
+func (index *articleIndex) Get(key string) (indexEntry, bool, error) {
+	var entry indexEntry
+	found := false
+	err := index.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getEntry(tx, []byte(key), &entry)
+		return err
+	})
+	return entry, found, err
+}
+
+// ByPMCID returns the article with the given PMCID and whether there is one.
+func (index *articleIndex) ByPMCID(pmcid string) (indexEntry, bool, error) {
+	return index.lookup(pmcidBucket, pmcid)
+}
+
+// ByDOI returns the article with the given DOI and whether there is one. DOIs
+// are matched without regard to case.
+func (index *articleIndex) ByDOI(doi string) (indexEntry, bool, error) {
+	return index.lookup(doiBucket, strings.ToLower(doi))
+}
+
+func (index *articleIndex) lookup(bucket []byte, id string) (indexEntry, bool, error) {
+	var entry indexEntry
+	found := false
+	err := index.db.View(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(bucket)
+		if ids == nil {
+			return nil
+		}
+		key := ids.Get([]byte(id))
+		if key == nil {
+			return nil
+		}
+		var err error
+		found, err = getEntry(tx, key, &entry)
+		return err
+	})
+	return entry, found, err
+}
+
+func getEntry(tx *bolt.Tx, key []byte, entry *indexEntry) (bool, error) {
+	articles := tx.Bucket(articlesBucket)
+	if articles == nil {
+		return false, nil
+	}
+	value := articles.Get(key)
+	if value == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(value, entry)
+}
+
+// ForEach calls onEntry with every article in the index in key order,
+// stopping at the first error onEntry returns.
+func (index *articleIndex) ForEach(onEntry func(entry indexEntry) error) error {
+	return index.db.View(func(tx *bolt.Tx) error {
+		articles := tx.Bucket(articlesBucket)
+		if articles == nil {
+			return nil
+		}
+		return articles.ForEach(func(key []byte, value []byte) error {
+			var entry indexEntry
+			err := json.Unmarshal(value, &entry)
+			if err != nil {
+				log.Print("issue reading the index entry of " + string(key))
+				return err
+			}
+			return onEntry(entry)
+		})
+	})
+}
+
+// Count returns the number of articles in the index.
+func (index *articleIndex) Count() (int, error) {
+	count := 0
+	err := index.db.View(func(tx *bolt.Tx) error {
+		articles := tx.Bucket(articlesBucket)
+		if articles != nil {
+			count = articles.Stats().KeyN
+		}
+		return nil
+	})
+	return count, err
+}
+
+// readListingCSV calls onEntry with each row of an article listing CSV. Rows
+// written before the listing was quoted may hold a DOI with commas in it, so
+// anything after the fourth column is taken to be the DOI. A missing listing
+// has no rows.
+func readListingCSV(listingPath string, onEntry func(entry indexEntry)) error {
+	listing, err := os.Open(listingPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer listing.Close()
+
+	reader := csv.NewReader(bufio.NewReader(listing))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(fields) < 4 {
+			log.Print("Skipping malformed listing row: " + strings.Join(fields, ","))
+			continue
+		}
+		entry := indexEntry{
+			PMCID: fields[3],
+			Path:  fields[1],
+			Date:  fields[2],
+		}
+		if !strings.HasPrefix(fields[0], "PMC") {
+			entry.PMID = fields[0]
+		}
+		if len(fields) > 4 {
+			entry.DOI = strings.Join(fields[4:], ",")
+		}
+		onEntry(entry)
+	}
+}
+
+// The number of listing rows imported in a single transaction. Committing
+// each row on its own would sync the index to disk once per row, which takes
+// hours for a listing of millions of articles.
+const importBatchSize = 5000
+
+// importListing adds every row of the article listing CSV at listingPath to
+// the index and returns the number of rows imported. Later rows for the same
+// article replace earlier ones, as they describe a later update. Rows whose
+// PMID already belongs to another article are logged and skipped. The
+// listing has no update times, so imported articles keep their revision.
+func (index *articleIndex) importListing(listingPath string) (int, error) {
+	imported := 0
+	batch := make([]indexEntry, 0, importBatchSize)
+	importBatch := func() error {
+		batchImported := 0
+		err := index.db.Update(func(tx *bolt.Tx) error {
+			for _, entry := range batch {
+				_, err := putTx(tx, entry)
+				var conflict *indexConflictError
+				if errors.As(err, &conflict) {
+					log.Print("Skipping listing row: " + conflict.Error())
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				batchImported++
+			}
+			return nil
+		})
+		if err == nil {
+			imported += batchImported
+		}
+		batch = batch[:0]
+		return err
+	}
+
+	var putErr error
+	err := readListingCSV(listingPath, func(entry indexEntry) {
+		if putErr != nil {
+			return
+		}
+		batch = append(batch, entry)
+		if len(batch) >= importBatchSize {
+			putErr = importBatch()
+		}
+	})
+	if err == nil {
+		err = putErr
+	}
+	if err == nil && len(batch) > 0 {
+		err = importBatch()
+	}
+	if err != nil {
+		log.Print("issue importing the article listing")
+	}
+	return imported, err
+}
+
+// exportListing writes the index as an article listing CSV, one row per
+// article. Fields are only quoted when they need to be, so the rows look like
+// those of the old listing unless a DOI has a comma in it.
+func (index *articleIndex) exportListing(out io.Writer) error {
+	writer := csv.NewWriter(out)
+	err := index.ForEach(func(entry indexEntry) error {
+		return writer.Write(entry.listingFields())
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// readIndex calls onEntry with every article in the corpus. It reads the
+// index without locking out other readers, or the old article listing if the
+// corpus has not been moved to an index yet.
+func readIndex(corpusLayout *layout, onEntry func(entry indexEntry)) error {
+	_, err := os.Stat(corpusLayout.IndexPath())
+	if os.IsNotExist(err) {
+		return readListingCSV(corpusLayout.ArticleListingPath(), onEntry)
+	}
+	index, err := openIndex(corpusLayout.IndexPath(), true)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	return index.ForEach(func(entry indexEntry) error {
+		onEntry(entry)
+		return nil
+	})
+}
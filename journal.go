@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// articleState is a step an article goes through on its way into the corpus.
+// Each one is a point a resumed run can pick up from: an id-converted article
+// is not sent to the ID converter again, a downloaded one is not downloaded
+// again and an extracted one only has its metadata written and indexed. The
+// PubMed metadata is not kept between runs, so it is always fetched again.
+type articleState string
+
+const (
+	stateUnknown     articleState = ""
+	stateDiscovered  articleState = "discovered"
+	stateIDConverted articleState = "id-converted"
+	stateDownloaded  articleState = "downloaded"
+	stateExtracted   articleState = "extracted"
+	stateIndexed     articleState = "indexed"
+	stateFailed      articleState = "failed"
+)
+
+// stateRank orders the states so callers can ask whether an article has
+// already made it past a given step. Failed articles are finished as far as
+// a sync is concerned so they rank with indexed ones. A state that is not
+// listed here, such as the metadata-fetched of older journals, ranks as not
+// started.
+var stateRank = map[articleState]int{
+	stateUnknown:     0,
+	stateDiscovered:  1,
+	stateIDConverted: 2,
+	stateDownloaded:  3,
+	stateExtracted:   4,
+	stateIndexed:     5,
+	stateFailed:      5,
+}
+
+// journalEntry is a single line of the progress journal.
+type journalEntry struct {
+	PMCID string       `json:"pmcid"`
+	State articleState `json:"state"`
+	// The OA service update timestamp of the version of the article this
+	// entry is about. A newer version starts again from discovered.
+	Updated string `json:"updated,omitempty"`
+	Time    string `json:"time"`
+	// Extra information such as the reason an article failed.
+	Detail string `json:"detail,omitempty"`
+	// What the ID converter said about the article, kept from id-converted
+	// until it is indexed so a resumed run does not have to ask again.
+	Identifiers *journalIdentifiers `json:"identifiers,omitempty"`
+}
+
+// journalIdentifiers are the identifiers the ID converter gave an article.
+// Either may be empty.
+type journalIdentifiers struct {
+	PMID string `json:"pmid,omitempty"`
+	DOI  string `json:"doi,omitempty"`
+}
+
+// progressJournal is an append-only record of the state of every article the
+// downloader has seen. Each change is written and synced to disk before the
+// next step starts, so after a crash the journal says exactly how far each
+// PMCID got. Only the latest entry for each PMCID matters; the rest are
+// dropped when the journal is compacted on open.
+type progressJournal struct {
+	mu          sync.Mutex
+	journalPath string
+	file        *os.File
+	latest      map[string]journalEntry
+}
+
+// readJournal returns the latest entry for each PMCID in the journal at
+// journalPath along with the number of lines read. A missing journal is
+// empty.
+func readJournal(journalPath string) (map[string]journalEntry, int, error) {
+	latest := make(map[string]journalEntry)
+	lineCount := 0
+	existingFile, err := os.Open(journalPath)
+	if os.IsNotExist(err) {
+		return latest, 0, nil
+	}
+	if err != nil {
+		log.Print("issue opening the progress journal")
+		return nil, 0, err
+	}
+	defer existingFile.Close()
+
+	scanner := bufio.NewScanner(existingFile)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			// Most likely the last line was cut off by a crash.
+			log.Print("Skipping unreadable journal line.")
+			continue
+		}
+		latest[entry.PMCID] = entry
+		lineCount++
+	}
+	err = scanner.Err()
+	if err != nil {
+		log.Print("issue reading the progress journal")
+		return nil, 0, err
+	}
+	return latest, lineCount, nil
+}
+
+func openJournal(journalPath string) (*progressJournal, error) {
+	latest, lineCount, err := readJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	journal := &progressJournal{
+		journalPath: journalPath,
+		latest:      latest,
+	}
+
+	// Rewrite the journal without the superseded entries once they make up
+	// most of the file.
+	if lineCount > 2*len(journal.latest) {
+		err = journal.compact()
+		if err != nil {
+			log.Print("issue compacting the progress journal")
+			return nil, err
+		}
+	}
+
+	journal.file, err = os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Print("issue opening the progress journal for writing")
+		return nil, err
+	}
+	err = endTornLine(journalPath, journal.file)
+	if err != nil {
+		log.Print("issue ending the last line of the progress journal")
+		journal.file.Close()
+		return nil, err
+	}
+	return journal, nil
+}
+
+// endTornLine starts a new line if the journal stops part way through one,
+// as it does when a crash cut off the last entry. Otherwise the next entry
+// would be appended to the torn one and be unreadable too.
+func endTornLine(journalPath string, file *os.File) error {
+	existingFile, err := os.Open(journalPath)
+	if err != nil {
+		return err
+	}
+	defer existingFile.Close()
+	info, err := existingFile.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	lastByte := make([]byte, 1)
+	_, err = existingFile.ReadAt(lastByte, info.Size()-1)
+	if err != nil || lastByte[0] == '\n' {
+		return err
+	}
+	_, err = file.Write([]byte{'\n'})
+	return err
+}
+
+// compact replaces the journal file with one holding only the latest entry
+// for each PMCID.
+func (journal *progressJournal) compact() error {
+	tempPath := journal.journalPath + ".tmp"
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tempFile)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range journal.latest {
+		err = encoder.Encode(entry)
+		if err != nil {
+			tempFile.Close()
+			os.Remove(tempPath)
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	tempFile.Close()
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, journal.journalPath)
+}
+
+// Entry returns the latest journal entry for pmcid and whether there is one.
+func (journal *progressJournal) Entry(pmcid string) (journalEntry, bool) {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	entry, found := journal.latest[pmcid]
+	return entry, found
+}
+
+// State returns how far the given version of an article has got. A different
+// version than the one in the journal has not been started yet.
+func (journal *progressJournal) State(pmcid string, updated string) articleState {
+	entry, found := journal.Entry(pmcid)
+	if !found || entry.Updated != updated {
+		return stateUnknown
+	}
+	return entry.State
+}
+
+// Reached reports whether the given version of an article has already made
+// it to state.
+func (journal *progressJournal) Reached(pmcid string, updated string, state articleState) bool {
+	return stateRank[journal.State(pmcid, updated)] >= stateRank[state]
+}
+
+// Identifiers returns the identifiers recorded for the given version of an
+// article and whether there are any. Only an article on its way from
+// id-converted to indexed has them.
+func (journal *progressJournal) Identifiers(pmcid string, updated string) (journalIdentifiers, bool) {
+	entry, found := journal.Entry(pmcid)
+	if !found || entry.Updated != updated || entry.Identifiers == nil {
+		return journalIdentifiers{}, false
+	}
+	return *entry.Identifiers, true
+}
+
+// RecordIdentifiers durably moves an article to id-converted along with the
+// identifiers the ID converter gave it.
+func (journal *progressJournal) RecordIdentifiers(pmcid string, updated string, pmid string, doi string) error {
+	return journal.write(journalEntry{
+		PMCID:       pmcid,
+		State:       stateIDConverted,
+		Updated:     updated,
+		Time:        time.Now().Format(time.RFC3339),
+		Identifiers: &journalIdentifiers{PMID: pmid, DOI: doi},
+	})
+}
+
+// Record durably moves an article to a new state. The identifiers of the
+// article are carried along until it is indexed, and dropped if it fails or
+// starts over.
+func (journal *progressJournal) Record(pmcid string, updated string, state articleState, detail string) error {
+	entry := journalEntry{
+		PMCID:   pmcid,
+		State:   state,
+		Updated: updated,
+		Time:    time.Now().Format(time.RFC3339),
+		Detail:  detail,
+	}
+	if stateRank[state] > stateRank[stateIDConverted] && state != stateIndexed && state != stateFailed {
+		previous, found := journal.Entry(pmcid)
+		if found && previous.Updated == updated {
+			entry.Identifiers = previous.Identifiers
+		}
+	}
+	return journal.write(entry)
+}
+
+// write appends entry to the journal and syncs it to disk.
+func (journal *progressJournal) write(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	pmcid := entry.PMCID
+
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	_, err = journal.file.Write(append(line, '\n'))
+	if err != nil {
+		log.Print("issue writing to the progress journal")
+		return err
+	}
+	err = journal.file.Sync()
+	if err != nil {
+		log.Print("issue syncing the progress journal")
+		return err
+	}
+	journal.latest[pmcid] = entry
+	return nil
+}
+
+// RestartFailed starts any of the given articles that the journal has as
+// failed again from discovered. processRecords takes failed articles as
+// finished, so anything that asks for an article again on purpose has to
+// restart it first. detail says what restarted it.
+func (journal *progressJournal) RestartFailed(records []record, detail string) error {
+	for _, currentRecord := range records {
+		entry, found := journal.Entry(currentRecord.ID)
+		if !found || entry.State != stateFailed {
+			continue
+		}
+		err := journal.Record(entry.PMCID, entry.Updated, stateDiscovered, detail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Advance records state unless the article has already got that far, so a
+// resumed run does not move an article backwards.
+func (journal *progressJournal) Advance(pmcid string, updated string, state articleState, detail string) error {
+	if journal.Reached(pmcid, updated, state) {
+		return nil
+	}
+	return journal.Record(pmcid, updated, state, detail)
+}
+
+func (journal *progressJournal) Close() error {
+	return journal.file.Close()
+}
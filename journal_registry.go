@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"./json_definitions"
+)
+
+// journalRegistry is the list of every journal the corpus has articles from,
+// kept in journals.json and keyed by NLM unique ID. The metadata of each
+// article names its journal by the same ID, so details such as the publisher
+// or every ISSN of a journal only have to be looked up in one place.
+type journalRegistry struct {
+	mu           sync.Mutex
+	registryPath string
+	journals     map[string]json_definitions.Journal
+	changed      bool
+}
+
+// openJournalRegistry reads the registry at registryPath. A missing registry
+// is empty.
+func openJournalRegistry(registryPath string) (*journalRegistry, error) {
+	registry := &journalRegistry{
+		registryPath: registryPath,
+		journals:     make(map[string]json_definitions.Journal),
+	}
+	registryBytes, err := ioutil.ReadFile(registryPath)
+	if os.IsNotExist(err) {
+		return registry, nil
+	}
+	if err != nil {
+		log.Print("issue reading the journal registry")
+		return nil, err
+	}
+	err = json.Unmarshal(registryBytes, &registry.journals)
+	if err != nil {
+		log.Print("issue unmarshalling the journal registry")
+		return nil, err
+	}
+	return registry, nil
+}
+
+// Add records the journal of an article. Journals without an NLM unique ID
+// cannot be told apart reliably and are left out. A journal that is already
+// known has any details it was missing filled in.
+func (registry *journalRegistry) Add(journal json_definitions.Journal) {
+	if journal.NlmUniqueID == "" {
+		return
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	known, found := registry.journals[journal.NlmUniqueID]
+	if !found {
+		registry.journals[journal.NlmUniqueID] = journal
+		registry.changed = true
+		return
+	}
+	merged := mergeJournal(known, journal)
+	if !journalsEqual(known, merged) {
+		registry.journals[journal.NlmUniqueID] = merged
+		registry.changed = true
+	}
+}
+
+// Journal returns the registry entry for an NLM unique ID and whether there
+// is one.
+func (registry *journalRegistry) Journal(nlmUniqueID string) (json_definitions.Journal, bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	journal, found := registry.journals[nlmUniqueID]
+	return journal, found
+}
+
+// Save writes the registry back to disk if anything was added. It is written
+// next to journals.json and renamed over it so readers never see half of it.
+func (registry *journalRegistry) Save() error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if !registry.changed {
+		return nil
+	}
+	registryBytes, err := json.MarshalIndent(registry.journals, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(path.Dir(registry.registryPath), 0755)
+	if err != nil {
+		return err
+	}
+	tempPath := registry.registryPath + ".tmp"
+	err = ioutil.WriteFile(tempPath, registryBytes, 0644)
+	if err == nil {
+		err = os.Rename(tempPath, registry.registryPath)
+	}
+	if err != nil {
+		log.Print("issue saving the journal registry")
+		os.Remove(tempPath)
+		return err
+	}
+	registry.changed = false
+	return nil
+}
+
+// mergeJournal fills the empty fields of known from update and adds any
+// ISSNs it did not have.
+func mergeJournal(known json_definitions.Journal, update json_definitions.Journal) json_definitions.Journal {
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&known.Title, update.Title)
+	fill(&known.ISOAbbreviation, update.ISOAbbreviation)
+	fill(&known.MedlineTA, update.MedlineTA)
+	fill(&known.ISSNLinking, update.ISSNLinking)
+	fill(&known.Country, update.Country)
+	fill(&known.Publisher, update.Publisher)
+
+	issns := append([]json_definitions.ISSN{}, known.ISSNs...)
+	for _, issn := range update.ISSNs {
+		seen := false
+		for _, knownISSN := range issns {
+			if knownISSN.ISSN == issn.ISSN {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			issns = append(issns, issn)
+		}
+	}
+	sort.Slice(issns, func(i, j int) bool {
+		return issns[i].ISSN < issns[j].ISSN
+	})
+	known.ISSNs = issns
+	return known
+}
+
+func journalsEqual(first json_definitions.Journal, second json_definitions.Journal) bool {
+	firstBytes, _ := json.Marshal(first)
+	secondBytes, _ := json.Marshal(second)
+	return string(firstBytes) == string(secondBytes)
+}
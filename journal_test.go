@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newJournalPath(t *testing.T) string {
+	journalRoot, err := ioutil.TempDir("", "PMCJournal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(journalRoot)
+	})
+	return path.Join(journalRoot, "progress_journal.jsonl")
+}
+
+// A run that stopped part way is picked up again by reopening the journal.
+// Articles that were indexed or failed are finished, the rest carry on from
+// the step they reached with the identifiers they were given, and a newer
+// version of an article starts over.
+func TestJournalResume(t *testing.T) {
+	journalPath := newJournalPath(t)
+	journal, err := openJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		pmcid string
+		state articleState
+	}{
+		{"PMC1", stateDiscovered},
+		{"PMC1", stateIDConverted},
+		{"PMC1", stateDownloaded},
+		{"PMC1", stateIndexed},
+		{"PMC2", stateDiscovered},
+		{"PMC2", stateIDConverted},
+		{"PMC2", stateFailed},
+		{"PMC3", stateDiscovered},
+		{"PMC3", stateIDConverted},
+		{"PMC3", stateDownloaded},
+	}
+	for _, step := range steps {
+		if step.state == stateIDConverted {
+			err = journal.RecordIdentifiers(step.pmcid, "2017-01-02 10:00:00", "1100000"+step.pmcid[3:], "")
+		} else {
+			err = journal.Record(step.pmcid, "2017-01-02 10:00:00", step.state, "")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal.Close()
+
+	journal, err = openJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	tests := []struct {
+		pmcid       string
+		updated     string
+		finished    bool
+		state       articleState
+		identifiers bool
+	}{
+		{"PMC1", "2017-01-02 10:00:00", true, stateIndexed, false},
+		{"PMC2", "2017-01-02 10:00:00", true, stateFailed, false},
+		{"PMC3", "2017-01-02 10:00:00", false, stateDownloaded, true},
+		{"PMC1", "2017-02-01 10:00:00", false, stateUnknown, false},
+		{"PMC4", "2017-01-02 10:00:00", false, stateUnknown, false},
+	}
+	for _, test := range tests {
+		if finished := journal.Reached(test.pmcid, test.updated, stateIndexed); finished != test.finished {
+			t.Errorf("%s %s: expected finished to be %v", test.pmcid, test.updated, test.finished)
+		}
+		if state := journal.State(test.pmcid, test.updated); state != test.state {
+			t.Errorf("%s %s: expected state %q, got %q", test.pmcid, test.updated, test.state, state)
+		}
+		if _, found := journal.Identifiers(test.pmcid, test.updated); found != test.identifiers {
+			t.Errorf("%s %s: expected identifiers to be kept to be %v", test.pmcid, test.updated, test.identifiers)
+		}
+	}
+	if identifiers, _ := journal.Identifiers("PMC3", "2017-01-02 10:00:00"); identifiers.PMID != "11000003" {
+		t.Errorf("expected the PMID of PMC3 to be carried to downloaded, got %+v", identifiers)
+	}
+
+	// A resumed article is not moved back to an earlier step.
+	err = journal.Advance("PMC3", "2017-01-02 10:00:00", stateDiscovered, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := journal.State("PMC3", "2017-01-02 10:00:00"); state != stateDownloaded {
+		t.Errorf("expected PMC3 to stay at %q, got %q", stateDownloaded, state)
+	}
+}
+
+// The journal is rewritten with only the latest entries once it has more than
+// twice as many lines as articles.
+func TestJournalCompaction(t *testing.T) {
+	tests := []struct {
+		name          string
+		records       int
+		expectedLines int
+	}{
+		// Two articles, so four lines is the most that is left alone.
+		{"at twice the articles", 3, 4},
+		{"over twice the articles", 4, 2},
+	}
+	for _, test := range tests {
+		journalPath := newJournalPath(t)
+		journal, err := openJournal(journalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = journal.Record("PMC2", "2017-01-02 10:00:00", stateIndexed, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		states := []articleState{stateDiscovered, stateIDConverted, stateDownloaded, stateIndexed}
+		for _, state := range states[len(states)-test.records:] {
+			err = journal.Record("PMC1", "2017-01-02 10:00:00", state, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		journal.Close()
+
+		journal, err = openJournal(journalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		journal.Close()
+		lines := readLines(t, journalPath)
+		if len(lines) != test.expectedLines {
+			t.Errorf("%s: expected %d lines, got %q", test.name, test.expectedLines, lines)
+		}
+		latest, _, err := readJournal(journalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(latest) != 2 || latest["PMC1"].State != stateIndexed || latest["PMC2"].State != stateIndexed {
+			t.Errorf("%s: unexpected entries %+v", test.name, latest)
+		}
+		_, err = os.Stat(journalPath + ".tmp")
+		if !os.IsNotExist(err) {
+			t.Errorf("%s: expected the temporary journal to be gone", test.name)
+		}
+	}
+}
+
+// A crash part way through writing an entry leaves a torn last line. It is
+// ignored, and entries written after it can still be read.
+func TestJournalTornLastLine(t *testing.T) {
+	journalPath := newJournalPath(t)
+	journalLines := `{"pmcid":"PMC1","state":"indexed","updated":"2017-01-02 10:00:00","time":"2017-01-02T10:05:00Z"}` + "\n" +
+		`{"pmcid":"PMC2","state":"downloaded","updated":"2017-01-02 10:00:00","time":"2017-01-02T10:05:01Z"}` + "\n" +
+		`{"pmcid":"PMC2","state":"ext`
+	err := ioutil.WriteFile(journalPath, []byte(journalLines), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := openJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := journal.State("PMC1", "2017-01-02 10:00:00"); state != stateIndexed {
+		t.Errorf("expected PMC1 to be indexed, got %q", state)
+	}
+	if state := journal.State("PMC2", "2017-01-02 10:00:00"); state != stateDownloaded {
+		t.Errorf("expected PMC2 to be back at downloaded, got %q", state)
+	}
+	err = journal.Record("PMC2", "2017-01-02 10:00:00", stateExtracted, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	latest, lineCount, err := readJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lineCount != 3 || latest["PMC2"].State != stateExtracted {
+		t.Errorf("expected the new entry to be readable, got %d lines and %+v", lineCount, latest)
+	}
+	lines := readLines(t, journalPath)
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], `{"pmcid":"PMC2","state":"ext`) {
+		t.Errorf("expected the torn line to be left on a line of its own, got %q", lines)
+	}
+}
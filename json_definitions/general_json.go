@@ -1,22 +1,113 @@
 package json_definitions
 
 type Metadata struct {
-	Title           string       `json:"title"`
-	AuthorList      []Author     `json:"author"`
-	Abstract        string       `json:"abstract"`
-	Identifier      []Identifier `json:"identifier"`
-	Date            Date         `json:"date"`
-	License         *string      `json:"license"`
-	Path            *string      `json:"path"`
-	EntryFile       string       `json:"entryfile"`
-	Files           *[]string    `json:"files"`
-	PathType        *string      `json:"path-type"`
-	CompressionType *string      `json:"compression-type"`
+	Title      string   `json:"title"`
+	AuthorList []Author `json:"author"`
+	Abstract   string   `json:"abstract"`
+	// The abstract with its inline markup, such as <i>, <sup> and <sub>,
+	// kept as XML. It is left out when there is no markup to keep.
+	AbstractMarkup string `json:"abstract-markup,omitempty"`
+	// The labelled sections of a structured abstract. Abstract holds them
+	// all joined together.
+	AbstractSections []AbstractSection `json:"abstract-sections,omitempty"`
+	Identifier       []Identifier      `json:"identifier"`
+	Date             Date              `json:"date"`
+	License          *string           `json:"license"`
+	Path             *string           `json:"path"`
+	EntryFile        string            `json:"entryfile"`
+	Files            *[]File           `json:"files"`
+	PathType         *string           `json:"path-type"`
+	CompressionType  *string           `json:"compression-type"`
+	// What the article is about, for filtering and faceting. Subjects,
+	// chemicals and publication types come from MEDLINE indexing, so
+	// articles without a PMID only have the keywords of their NXML.
+	Subjects         []Subject         `json:"subjects,omitempty"`
+	Keywords         []string          `json:"keywords,omitempty"`
+	Chemicals        []Chemical        `json:"chemicals,omitempty"`
+	PublicationTypes []PublicationType `json:"publication-types,omitempty"`
+	// Where the article was published. Journal.NlmUniqueID is the key of
+	// the journal in journals.json.
+	Journal *Journal `json:"journal,omitempty"`
+	Volume  string   `json:"volume,omitempty"`
+	Issue   string   `json:"issue,omitempty"`
+	Pages   string   `json:"pages,omitempty"`
+}
+
+// Journal is the journal an article was published in. The same details are
+// kept once per journal in journals.json.
+type Journal struct {
+	NlmUniqueID     string `json:"nlm-unique-id,omitempty"`
+	Title           string `json:"title"`
+	ISOAbbreviation string `json:"iso-abbreviation,omitempty"`
+	MedlineTA       string `json:"medline-ta,omitempty"`
+	ISSNs           []ISSN `json:"issns,omitempty"`
+	// The ISSN-L that links the print and electronic ISSNs of a journal.
+	ISSNLinking string `json:"issn-linking,omitempty"`
+	Country     string `json:"country,omitempty"`
+	Publisher   string `json:"publisher,omitempty"`
+}
+
+// ISSN is one of the ISSNs of a journal. Type is print or electronic.
+type ISSN struct {
+	Type string `json:"type,omitempty"`
+	ISSN string `json:"issn"`
+}
+
+// Subject is a MeSH heading: a descriptor such as "Neoplasms", narrowed by
+// any qualifiers such as "drug therapy". MajorTopic marks the main subjects
+// of the article.
+type Subject struct {
+	Descriptor   string      `json:"descriptor"`
+	DescriptorUI string      `json:"descriptor-ui,omitempty"`
+	MajorTopic   bool        `json:"major-topic"`
+	Qualifiers   []Qualifier `json:"qualifiers,omitempty"`
+}
+
+type Qualifier struct {
+	Name       string `json:"name"`
+	UI         string `json:"ui,omitempty"`
+	MajorTopic bool   `json:"major-topic"`
+}
+
+// Chemical is a substance the article discusses. RegistryNumber is its CAS
+// or EC number where it has one.
+type Chemical struct {
+	Name           string `json:"name"`
+	UI             string `json:"ui,omitempty"`
+	RegistryNumber string `json:"registry-number,omitempty"`
+}
+
+// PublicationType is a MeSH publication type such as "Journal Article" or
+// "Randomized Controlled Trial".
+type PublicationType struct {
+	Name string `json:"name"`
+	UI   string `json:"ui,omitempty"`
+}
+
+// File is a single file stored for an article. Name is relative to the
+// article's path, like EntryFile.
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	MIME string `json:"mime"`
+}
+
+// AbstractSection is a section of a structured abstract. Category is the
+// NLM category it was filed under, such as METHODS. Markup is Text with its
+// inline markup kept as XML, and is left out when there is none.
+type AbstractSection struct {
+	Label    string `json:"label"`
+	Category string `json:"category,omitempty"`
+	Text     string `json:"text"`
+	Markup   string `json:"markup,omitempty"`
 }
 
 type Author struct {
 	Surname    string `json:"surname"`
 	GivenNames string `json:"given-names"`
+	// Collab is the name of a group author such as a consortium, which has
+	// no surname or given names.
+	Collab string `json:"collab,omitempty"`
 }
 
 type Identifier struct {
@@ -24,8 +115,14 @@ type Identifier struct {
 	ID   string `json:"id"`
 }
 
+// Date is the publication date of an article. Day and Month are empty when
+// the source only gives the month or year. ISO holds the same date as
+// YYYY-MM-DD, YYYY-MM or YYYY, and Source says which date of the record it
+// was taken from, such as date-completed or history:received.
 type Date struct {
-	Day   string `json:"day"`
-	Month string `json:"month"`
-	Year  string `json:"year"`
+	Day    string `json:"day"`
+	Month  string `json:"month"`
+	Year   string `json:"year"`
+	ISO    string `json:"iso,omitempty"`
+	Source string `json:"source,omitempty"`
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path"
+)
+
+// The folder in the working directory the corpus is kept in when no data
+// root is given on the command line, in the environment or in config.json.
+const defaultDataRootName = "PMCData"
+
+// dataRootEnvVar and configEnvVar override the default data root and config
+// file. The --data-root and --config flags override both.
+const dataRootEnvVar = "PMC_DATA_ROOT"
+const configEnvVar = "PMC_CONFIG"
+
+// layoutConfig is the "layout" section of config.json. It moves parts of the
+// corpus away from their default place in the data root, for example to put
+// the articles on a separate volume. Relative paths are relative to the data
+// root and empty ones keep the default.
+type layoutConfig struct {
+	Articles string `json:"articles,omitempty"`
+	Metadata string `json:"metadata,omitempty"`
+	OAFiles  string `json:"oa_files,omitempty"`
+}
+
+// layout describes where every part of a corpus is kept on disk. Everything
+// that reads or writes the corpus asks the layout for its paths.
+type layout struct {
+	DataRoot string
+	// Where config.json is read from and saved to.
+	ConfigPath string
+	// The extracted article packages, under their two hashed folders.
+	ArticlesPath string
+	// The sciencefair metadata JSON files, under the same hashed folders.
+	MetadataPath string
+	// The index, listings, journal and checkpoints.
+	OAFilesPath string
+}
+
+// newLayout returns the layout of the corpus under dataRoot with the
+// config file kept in the data root.
+func newLayout(dataRoot string, overrides layoutConfig) *layout {
+	resolve := func(override string, defaultName string) string {
+		if override == "" {
+			return path.Join(dataRoot, defaultName)
+		}
+		if path.IsAbs(override) {
+			return path.Clean(override)
+		}
+		return path.Join(dataRoot, override)
+	}
+	return &layout{
+		DataRoot:     dataRoot,
+		ConfigPath:   path.Join(dataRoot, "config.json"),
+		ArticlesPath: resolve(overrides.Articles, "articles"),
+		MetadataPath: resolve(overrides.Metadata, "metadata"),
+		OAFilesPath:  resolve(overrides.OAFiles, "oa_files"),
+	}
+}
+
+// explicitConfigPath reports whether the config file is named by configFlag
+// or the PMC_CONFIG environment variable rather than found in the data root.
+// Only such a config file can say where the data root is.
+func explicitConfigPath(configFlag string) bool {
+	return configFlag != "" || os.Getenv(configEnvVar) != ""
+}
+
+// resolveLayout finds config.json and the data root for a run and returns
+// both. The config file is configFlag, then the PMC_CONFIG environment
+// variable, then config.json in the data root. The data root is
+// dataRootFlag, then the PMC_DATA_ROOT environment variable, then data_root in
+// config.json, then PMCData in the working directory.
+func resolveLayout(dataRootFlag string, configFlag string) (*config, *layout, error) {
+	dataRoot := dataRootFlag
+	if dataRoot == "" {
+		dataRoot = os.Getenv(dataRootEnvVar)
+	}
+
+	configPath := configFlag
+	if configPath == "" {
+		configPath = os.Getenv(configEnvVar)
+	}
+	if configPath == "" {
+		configRoot := dataRoot
+		if configRoot == "" {
+			configRoot = defaultDataRoot()
+		}
+		configPath = path.Join(configRoot, "config.json")
+	}
+
+	runConfig, err := loadConfig(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if dataRoot == "" && runConfig.DataRoot != "" {
+		// A relative data_root is relative to the config file.
+		dataRoot = runConfig.DataRoot
+		if !path.IsAbs(dataRoot) {
+			dataRoot = path.Join(path.Dir(configPath), dataRoot)
+		}
+	}
+	if dataRoot == "" {
+		dataRoot = defaultDataRoot()
+	}
+
+	corpusLayout := newLayout(dataRoot, runConfig.Layout)
+	corpusLayout.ConfigPath = configPath
+	return runConfig, corpusLayout, nil
+}
+
+// loadConfig reads the config file at configPath. A missing file is an empty
+// config so that the config command can create one.
+func loadConfig(configPath string) (*config, error) {
+	_, err := os.Stat(configPath)
+	if os.IsNotExist(err) {
+		return &config{}, nil
+	}
+	return readJSON(configPath)
+}
+
+// defaultDataRoot is PMCData in the working directory.
+func defaultDataRoot() string {
+	pwd, err := os.Getwd()
+	if err != nil {
+		return defaultDataRootName
+	}
+	return path.Join(pwd, defaultDataRootName)
+}
+
+// IndexPath is the embedded database of every saved article.
+func (corpusLayout *layout) IndexPath() string {
+	return path.Join(corpusLayout.OAFilesPath, "article_index.db")
+}
+
+// ArticleListingPath is the CSV listing the index replaced. It is imported
+// into a new index and is where the index is exported to by default.
+func (corpusLayout *layout) ArticleListingPath() string {
+	return path.Join(corpusLayout.OAFilesPath, "article_listing.csv")
+}
+
+func (corpusLayout *layout) BadArticleListingPath() string {
+	return path.Join(corpusLayout.OAFilesPath, "bad_article_listing.csv")
+}
+
+func (corpusLayout *layout) JournalPath() string {
+	return path.Join(corpusLayout.OAFilesPath, "article_journal.jsonl")
+}
+
+// JournalRegistryPath is the list of every journal the metadata files refer
+// to, kept alongside them.
+func (corpusLayout *layout) JournalRegistryPath() string {
+	return path.Join(corpusLayout.MetadataPath, "journals.json")
+}
+
+// UpdateCheckpointPath is where a sync keeps the page it is working on.
+func (corpusLayout *layout) UpdateCheckpointPath() string {
+	return path.Join(corpusLayout.OAFilesPath, "update_checkpoint.json")
+}
+
+// BackfillCheckpointPath is where a backfill keeps the page it is working on.
+func (corpusLayout *layout) BackfillCheckpointPath() string {
+	return path.Join(corpusLayout.OAFilesPath, "backfill_checkpoint.json")
+}
+
+// ArticleFolder is the folder shared by every article with the given hashed
+// folders, such as "08/e0". Packages are extracted into it.
+func (corpusLayout *layout) ArticleFolder(hashPath string) string {
+	return path.Join(corpusLayout.ArticlesPath, hashPath)
+}
+
+// ArticlePath is the folder holding the files of a single article.
+func (corpusLayout *layout) ArticlePath(hashPath string, pmcid string) string {
+	return path.Join(corpusLayout.ArticlesPath, hashPath, pmcid)
+}
+
+// StagingFolder is where a new version of an article is put together before
+// it replaces the one in ArticlePath. It is next to the article so the two can
+// be swapped by renaming.
+func (corpusLayout *layout) StagingFolder(hashPath string, pmcid string) string {
+	return path.Join(corpusLayout.ArticlesPath, hashPath, "."+pmcid+".staging")
+}
+
+// ArchivePath is where an article package is downloaded to before it is
+// extracted.
+func (corpusLayout *layout) ArchivePath(hashPath string, pmcid string) string {
+	return path.Join(corpusLayout.ArticlesPath, hashPath, pmcid+".tar.gz")
+}
+
+// MetadataFolder is the folder holding the metadata of every article with
+// the given hashed folders.
+func (corpusLayout *layout) MetadataFolder(hashPath string) string {
+	return path.Join(corpusLayout.MetadataPath, hashPath)
+}
+
+// MetadataFilePath is the metadata JSON file of a single article.
+func (corpusLayout *layout) MetadataFilePath(hashPath string, pmid string) string {
+	return path.Join(corpusLayout.MetadataPath, hashPath, "PubMedCentral-"+pmid+"-v2.json")
+}
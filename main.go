@@ -2,17 +2,18 @@ package main
 
 import (
 	"encoding/json"
-	"encoding/xml"
 	"errors"
-	"io"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"strings"
 	"time"
+	// NCBI time has to be known whatever the time zone database of the
+	// machine has in it.
+	_ "time/tzdata"
 
 	"./json_definitions"
 	"./xml_definitions"
@@ -20,65 +21,38 @@ import (
 	"github.com/hashicorp/go-getter"
 )
 
-func downloadXML(url string) error {
-	// Build the file path.
-	pwd, _ := os.Getwd()
-	basePath := path.Join(pwd, "oa_files", "oa_file_list_")
-	const baseEnd = ".csv"
-	//const url = "http://ftp.ncbi.nlm.nih.gov/pub/pmc/oa_file_list.csv"
-
-	filePath := basePath + time.Now().Format("20060102150405") + baseEnd
-
-	// Create a file to put the data in.
-	outFile, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer outFile.Close()
-
-	// Download the data.
-	urlResponse, err := http.Get(url)
-	if err != nil {
-		os.Remove(filePath)
-		return err
-	}
-
-	defer urlResponse.Body.Close()
-
-	// Write the data to the file.
-	_, err = io.Copy(outFile, urlResponse.Body)
-	if err != nil {
-		os.Remove(filePath)
-		return err
-	}
-
-	return nil
-}
-
-func downloadUpdateXML(url string) ([]byte, error) {
-	//log.Print(url)
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("Status error on: " + url + " Code: " + string(resp.StatusCode))
-	}
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.New("Read Body error on :" + url)
-	}
-
-	return data, nil
-}
-
 type config struct {
+	// The from= of the next sync, as YYYYMMDDhhmmss in NCBI time. See
+	// ncbiLocation.
 	LastDate     string `json:"last_date"`
 	LastSize     int64  `json:"last_size"`
 	EmailAddress string `json:"email"`
+	// An NCBI API key raises the request budget from 3 to 10 requests per
+	// second. It can also be supplied with the NCBI_API_KEY environment
+	// variable.
+	APIKey string `json:"api_key"`
+	// The time the current (or most recent) run started, in NCBI time and
+	// less watermarkOverlap. Once a run has processed every page this becomes
+	// LastDate so the next run only asks for records updated since then.
+	RunStarted string `json:"run_started"`
+	// Running totals for the current run, committed after every page.
+	PagesProcessed    int `json:"pages_processed"`
+	ArticlesProcessed int `json:"articles_processed"`
+	BadArticles       int `json:"bad_articles"`
+	// The number of articles to download at the same time.
+	Concurrency int `json:"concurrency"`
+	// Where the corpus is kept when neither --data-root nor PMC_DATA_ROOT is
+	// given. A relative path is relative to this file. It can only be set in
+	// a config file named by --config or PMC_CONFIG, see explicitConfigPath.
+	DataRoot string `json:"data_root"`
+	// Where each part of the corpus is kept within the data root.
+	Layout layoutConfig `json:"layout"`
+	// Which formats of each article to download: tgz, pdf, both or
+	// prefer-tgz. Empty means tgz.
+	Formats string `json:"formats"`
+	// The identifiers, pmid and doi, an article must have to be kept. When
+	// missing neither is required.
+	RequiredIdentifiers []string `json:"required_identifiers"`
 }
 
 func readJSON(configPath string) (*config, error) {
@@ -111,16 +85,80 @@ func saveJSON(newConfig *config, configPath string) error {
 		return err
 	}
 
-	jsonFile, err := os.Open(configPath)
+	// Write to a temporary file first and then move it into place so the
+	// config is replaced atomically and is created if it does not exist yet.
+	tempPath := configPath + ".tmp"
+	err = ioutil.WriteFile(tempPath, jsonString, 0644)
 	if err != nil {
 		log.Print("unable to open json file to write")
-		return errors.New("unable to open json file to write")
+		return errors.New("unable to write to file")
 	}
-	defer jsonFile.Close()
+	err = os.Rename(tempPath, configPath)
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.New("unable to move json file into place")
+	}
+	return nil
+}
+
+// updateCheckpoint records how far through a paged OA service response a
+// sync has progressed. It is rewritten after every completed page so that an
+// interrupted run can pick up on the page it was working on instead of
+// starting over from the first one.
+type updateCheckpoint struct {
+	// The from= and until= values of the run this checkpoint belongs to. A
+	// checkpoint left behind by a run over a different range is ignored.
+	From  string `json:"from"`
+	Until string `json:"until,omitempty"`
+	// The URL of the next page that still needs to be processed.
+	PageURL string `json:"page_url"`
+	// The number of the page at PageURL, starting at 1.
+	PageNumber int `json:"page_number"`
+}
 
-	err = ioutil.WriteFile(configPath, jsonString, 0644)
+func readCheckpoint(checkpointPath string) (*updateCheckpoint, error) {
+	var loadedCheckpoint updateCheckpoint
+
+	byteArray, err := ioutil.ReadFile(checkpointPath)
 	if err != nil {
-		return errors.New("unable to write to file")
+		return nil, err
+	}
+
+	err = json.Unmarshal(byteArray, &loadedCheckpoint)
+	if err != nil {
+		log.Print("unable to parse update checkpoint")
+		return nil, err
+	}
+
+	return &loadedCheckpoint, nil
+}
+
+func saveCheckpoint(newCheckpoint *updateCheckpoint, checkpointPath string) error {
+	jsonString, err := json.Marshal(newCheckpoint)
+	if err != nil {
+		log.Print("Unable to marshal checkpoint data.")
+		return err
+	}
+
+	// Write to a temporary file first and then move it into place so a crash
+	// part way through never leaves a truncated checkpoint behind.
+	tempPath := checkpointPath + ".tmp"
+	err = ioutil.WriteFile(tempPath, jsonString, 0644)
+	if err != nil {
+		return errors.New("unable to write checkpoint file")
+	}
+	err = os.Rename(tempPath, checkpointPath)
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.New("unable to move checkpoint file into place")
+	}
+	return nil
+}
+
+func clearCheckpoint(checkpointPath string) error {
+	err := os.Remove(checkpointPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
 	return nil
 }
@@ -156,9 +194,15 @@ type recordLink struct {
 }
 
 type record struct {
-	ID       string     `xml:"id,attr"`
-	Citation string     `xml:"citation,attr"`
-	Link     recordLink `xml:"link"`
+	ID       string `xml:"id,attr"`
+	Citation string `xml:"citation,attr"`
+	// The license the article is shared under, such as CC BY or CC BY-NC.
+	License string       `xml:"license,attr"`
+	Links   []recordLink `xml:"link"`
+	// The links chosen by the format policy, any tgz package first, and the
+	// first of them, which the article is tracked by. See selectFormats.
+	Downloads []recordLink `xml:"-"`
+	Link      recordLink   `xml:"-"`
 }
 
 type records struct {
@@ -174,6 +218,155 @@ type databaseUpdate struct {
 	ResponseDate string  `xml:"responseDate"`
 	Request      request `xml:"request"`
 	Records      records `xml:"records"`
+	// Set instead of Records when the service turns the request down.
+	Error oaError `xml:"error"`
+}
+
+type oaError struct {
+	Code    string `xml:"code,attr"`
+	Message string `xml:",chardata"`
+}
+
+// addSubjectMetadata copies the MeSH headings, keywords, chemicals and
+// publication types of a PubMed record into its metadata.
+func addSubjectMetadata(tempJSON *json_definitions.Metadata, citation *xml_definitions.MedlineCitation) {
+	for _, heading := range citation.MeshHeadingList {
+		subject := json_definitions.Subject{
+			Descriptor:   strings.TrimSpace(heading.DescriptorName.Name),
+			DescriptorUI: heading.DescriptorName.UI,
+			MajorTopic:   heading.DescriptorName.MajorTopicYN == "Y",
+		}
+		for _, qualifierName := range heading.QualifierNames {
+			subject.Qualifiers = append(subject.Qualifiers, json_definitions.Qualifier{
+				Name:       strings.TrimSpace(qualifierName.Name),
+				UI:         qualifierName.UI,
+				MajorTopic: qualifierName.MajorTopicYN == "Y",
+			})
+		}
+		tempJSON.Subjects = append(tempJSON.Subjects, subject)
+	}
+
+	// The same keyword can be given by more than one owner.
+	seenKeywords := make(map[string]bool)
+	for _, keywordList := range citation.KeywordLists {
+		for _, keyword := range keywordList.Keywords {
+			addKeyword(tempJSON, seenKeywords, keyword.String())
+		}
+	}
+
+	for _, chemical := range citation.ChemicalList {
+		registryNumber := strings.TrimSpace(chemical.RegistryNumber)
+		// Substances without a registry number are given 0.
+		if registryNumber == "0" {
+			registryNumber = ""
+		}
+		tempJSON.Chemicals = append(tempJSON.Chemicals, json_definitions.Chemical{
+			Name:           strings.TrimSpace(chemical.NameOfSubstance.Name),
+			UI:             chemical.NameOfSubstance.UI,
+			RegistryNumber: registryNumber,
+		})
+	}
+
+	for _, publicationType := range citation.Article.PublicationTypeList {
+		tempJSON.PublicationTypes = append(tempJSON.PublicationTypes, json_definitions.PublicationType{
+			Name: strings.TrimSpace(publicationType.Type),
+			UI:   publicationType.UI,
+		})
+	}
+}
+
+// addJournalMetadata copies the journal, volume, issue and pages of a PubMed
+// record into its metadata.
+func addJournalMetadata(tempJSON *json_definitions.Metadata, citation *xml_definitions.MedlineCitation) {
+	articleJournal := citation.Article.Journal
+	journalInfo := citation.MedlineJournalInfo
+	journal := json_definitions.Journal{
+		NlmUniqueID:     strings.TrimSpace(journalInfo.NlmUniqueID),
+		Title:           strings.TrimSpace(articleJournal.Title),
+		ISOAbbreviation: strings.TrimSpace(articleJournal.ISOAbbreviation),
+		MedlineTA:       strings.TrimSpace(journalInfo.MedlineTA),
+		ISSNLinking:     strings.TrimSpace(journalInfo.ISSNLinking),
+		Country:         strings.TrimSpace(journalInfo.Country),
+	}
+	issn := strings.TrimSpace(articleJournal.ISSN.ISSNValue)
+	if issn != "" {
+		journal.ISSNs = append(journal.ISSNs, json_definitions.ISSN{
+			Type: strings.ToLower(articleJournal.ISSN.IssnType),
+			ISSN: issn,
+		})
+	}
+	if journal.Title != "" || journal.NlmUniqueID != "" {
+		tempJSON.Journal = &journal
+	}
+
+	tempJSON.Volume = strings.TrimSpace(articleJournal.JournalIssue.Volume)
+	tempJSON.Issue = strings.TrimSpace(articleJournal.JournalIssue.Issue)
+	if len(citation.Article.Pagination.MedlinePgns) > 0 {
+		tempJSON.Pages = strings.TrimSpace(citation.Article.Pagination.MedlinePgns[0])
+	}
+}
+
+// The pub-type values JATS 1.0 gives an ISSN, and the publication-format
+// values of later versions, mapped to the ISSN types PubMed uses.
+var jatsISSNTypes = map[string]string{
+	"ppub":       "print",
+	"epub":       "electronic",
+	"print":      "print",
+	"electronic": "electronic",
+}
+
+// addJATSJournalMetadata copies the journal, volume, issue and pages from the
+// front matter of an NXML into its metadata. The NXML does not carry the NLM
+// unique ID, so these journals are left out of the journal registry.
+func addJATSJournalMetadata(tempJSON *json_definitions.Metadata, front *xml_definitions.JATSFront) {
+	journalMeta := front.JournalMeta
+	journal := json_definitions.Journal{
+		Title:     strings.TrimSpace(journalMeta.JournalTitle),
+		Publisher: strings.TrimSpace(journalMeta.Publisher),
+	}
+	for _, journalID := range journalMeta.JournalIDs {
+		switch journalID.Type {
+		case "nlm-ta":
+			journal.MedlineTA = strings.TrimSpace(journalID.ID)
+		case "iso-abbrev":
+			journal.ISOAbbreviation = strings.TrimSpace(journalID.ID)
+		}
+	}
+	for _, issn := range journalMeta.ISSNs {
+		issnType := issn.PublicationFormat
+		if issnType == "" {
+			issnType = issn.PubType
+		}
+		if strings.TrimSpace(issn.ISSN) == "" {
+			continue
+		}
+		journal.ISSNs = append(journal.ISSNs, json_definitions.ISSN{
+			Type: jatsISSNTypes[issnType],
+			ISSN: strings.TrimSpace(issn.ISSN),
+		})
+	}
+	if journal.Title != "" {
+		tempJSON.Journal = &journal
+	}
+
+	articleMeta := front.ArticleMeta
+	tempJSON.Volume = strings.TrimSpace(articleMeta.Volume)
+	tempJSON.Issue = strings.TrimSpace(articleMeta.Issue)
+	tempJSON.Pages = strings.TrimSpace(articleMeta.FPage)
+	lastPage := strings.TrimSpace(articleMeta.LPage)
+	if tempJSON.Pages != "" && lastPage != "" && lastPage != tempJSON.Pages {
+		tempJSON.Pages += "-" + lastPage
+	}
+}
+
+// addKeyword adds a keyword to the metadata unless it is empty or already
+// there in some other case.
+func addKeyword(tempJSON *json_definitions.Metadata, seenKeywords map[string]bool, keyword string) {
+	if keyword == "" || seenKeywords[strings.ToLower(keyword)] {
+		return
+	}
+	seenKeywords[strings.ToLower(keyword)] = true
+	tempJSON.Keywords = append(tempJSON.Keywords, keyword)
 }
 
 func convertXMLToJSON(xmlStruct *xml_definitions.PubmedArticle, articlePath string, doi *string, pmcid string) (*json_definitions.Metadata, error) {
@@ -185,9 +378,10 @@ func convertXMLToJSON(xmlStruct *xml_definitions.PubmedArticle, articlePath stri
 		CompressionType: &compressionType,
 		// This designates that it is already broken up into paths deleniated by
 		// the "/" symbol.
-		PathType:  &pathType,
-		Path:      &articlePath,
-		EntryFile: "main.nxml",
+		PathType: &pathType,
+		Path:     &articlePath,
+		// The entry file and file list depend on what the package held, so
+		// they are filled in once it has been extracted.
 	}
 
 	// Need to at least pull out:
@@ -196,17 +390,40 @@ func convertXMLToJSON(xmlStruct *xml_definitions.PubmedArticle, articlePath stri
 	// Identifier
 	// Date
 	// AuthorList
-	// License
-	// Possibly try and grab the license with this?: It is in the nxml files so we will get it later if we need it but this should be fine for now.
-	// https://www.ncbi.nlm.nih.gov/pmc/oai/oai.cgi?verb=GetRecord&identifier=oai:pubmedcentral.nih.gov:3728067&metadataPrefix=oai_dc
+	// The license comes from the OA record and is filled in once the article
+	// has been downloaded.
 	tempJSON.Title = xmlStruct.MedlineCitation.Article.ArticleTitle
-	tempJSON.Abstract = xmlStruct.MedlineCitation.Article.Abstract.AbstractText
+	abstract := xmlStruct.MedlineCitation.Article.Abstract
+	tempJSON.Abstract = abstract.String()
+	// The markup is only kept where it adds something to the plain text.
+	if markup := abstract.Markup(); markup != tempJSON.Abstract {
+		tempJSON.AbstractMarkup = markup
+	}
+	for _, abstractText := range abstract.AbstractTexts {
+		// Only structured abstracts have labels, and an abstract that is a
+		// single section is already all in Abstract.
+		if abstractText.Label == "" && abstractText.NlmCategory == "" {
+			continue
+		}
+		section := json_definitions.AbstractSection{
+			Label:    abstractText.Label,
+			Category: abstractText.NlmCategory,
+			Text:     abstractText.String(),
+		}
+		if markup := abstractText.Markup(); markup != section.Text {
+			section.Markup = markup
+		}
+		tempJSON.AbstractSections = append(tempJSON.AbstractSections, section)
+	}
+	addSubjectMetadata(&tempJSON, &xmlStruct.MedlineCitation)
+	addJournalMetadata(&tempJSON, &xmlStruct.MedlineCitation)
 	tempIdentifier := json_definitions.Identifier{
 		Type: "pmid",
 		ID:   xmlStruct.MedlineCitation.PMID.PMID,
 	}
 	tempJSON.Identifier = append(tempJSON.Identifier, tempIdentifier)
-	if doi != nil {
+	// Plenty of articles have no DOI, in which case the identifier is left out.
+	if doi != nil && *doi != "" {
 		tempDOI := json_definitions.Identifier{
 			Type: "doi",
 			ID:   *doi,
@@ -218,12 +435,7 @@ func convertXMLToJSON(xmlStruct *xml_definitions.PubmedArticle, articlePath stri
 		ID:   pmcid,
 	}
 	tempJSON.Identifier = append(tempJSON.Identifier, tempPMCID)
-	tempDate := json_definitions.Date{
-		Day:   xmlStruct.MedlineCitation.DateCompleted.Day,
-		Month: xmlStruct.MedlineCitation.DateCompleted.Month,
-		Year:  xmlStruct.MedlineCitation.DateCompleted.Year,
-	}
-	tempJSON.Date = tempDate
+	tempJSON.Date = resolvePubmedDate(xmlStruct)
 	for author := 0; author < len(xmlStruct.MedlineCitation.Article.AuthorList.Authors); author++ {
 		tempAuthor := json_definitions.Author{
 			Surname:    xmlStruct.MedlineCitation.Article.AuthorList.Authors[author].LastName,
@@ -235,377 +447,694 @@ func convertXMLToJSON(xmlStruct *xml_definitions.PubmedArticle, articlePath stri
 	return &tempJSON, nil
 }
 
-func downloadArticle(url string, destination string) error {
-	// Download the article at url and extract it to destination.
-	tempURL := url + "?archnive=false"
-	os.MkdirAll(destination, 0655)
-	//log.Print("Destination: " + destination)
-	err := getter.Get(destination, tempURL)
-	if err == nil {
-		//log.Print("Downloaded " + url)
-	} else {
-		log.Print("Error downloading article. See error below:")
+// The pub-date types of a JATS article in the order they are preferred when
+// picking the date of an article. Anything else is only used if there is
+// nothing better.
+var jatsDatePreference = []string{"epub", "pub", "ppub", "epub-ppub", "collection"}
+
+// convertJATSToJSON builds the sciencefair metadata of an article from the
+// front matter of its own NXML. It is used for articles PubMed knows nothing
+// about. The DOI from the ID converter wins over the one in the NXML.
+func convertJATSToJSON(jatsArticle *xml_definitions.JATSArticle, articlePath string, doi *string, pmcid string) (*json_definitions.Metadata, error) {
+	articleMeta := jatsArticle.Front.ArticleMeta
+	pathType := "/"
+	compressionType := "tgz"
+
+	tempJSON := json_definitions.Metadata{
+		CompressionType: &compressionType,
+		PathType:        &pathType,
+		Path:            &articlePath,
+		Title:           articleMeta.ArticleTitle.String(),
+	}
+	if tempJSON.Title == "" {
+		return nil, errors.New("the NXML of " + pmcid + " has no article title")
 	}
-	return err
-}
 
-func downloadMetaDataXML(url string) (*xml_definitions.PubmedArticleSet, error) {
-	// Download the data.
-	urlResponse, err := http.Get(url)
-	if err != nil {
-		return nil, err
+	abstracts := []string{}
+	for _, abstract := range articleMeta.Abstracts {
+		// Graphical and teaser abstracts repeat the main one.
+		if abstract.AbstractType != "" && abstract.AbstractType != "summary" {
+			continue
+		}
+		abstracts = append(abstracts, abstract.String())
 	}
+	tempJSON.Abstract = strings.Join(abstracts, " ")
 
-	defer urlResponse.Body.Close()
-	//log.Print(url)
+	seenKeywords := make(map[string]bool)
+	for _, keyword := range articleMeta.Keywords {
+		addKeyword(&tempJSON, seenKeywords, keyword.String())
+	}
+	addJATSJournalMetadata(&tempJSON, &jatsArticle.Front)
 
-	// Read the data to a []char.
-	dataString, err := ioutil.ReadAll(urlResponse.Body)
-	if err != nil {
-		log.Print("Error reading the metadata file.")
-		return nil, err
+	articleDOI := ""
+	if doi != nil {
+		articleDOI = *doi
 	}
-	// Parse the XML data.
-	pubMedMetadata := xml_definitions.PubmedArticleSet{}
-	err = xml.Unmarshal(dataString, &pubMedMetadata)
-	if err != nil {
-		//log.Print(pubMedMetadata)
-		log.Print(url)
-		log.Print("issue unmarshalling xml metadata")
-		log.Print(err)
-		log.Print(dataString)
-		return nil, err
+	for _, articleID := range articleMeta.ArticleIDs {
+		if articleID.PubIDType == "doi" && articleDOI == "" {
+			articleDOI = strings.TrimSpace(articleID.ID)
+		}
+	}
+	if articleDOI != "" {
+		tempJSON.Identifier = append(tempJSON.Identifier, json_definitions.Identifier{
+			Type: "doi",
+			ID:   articleDOI,
+		})
+	}
+	tempJSON.Identifier = append(tempJSON.Identifier, json_definitions.Identifier{
+		Type: "pmcid",
+		ID:   pmcid,
+	})
+
+	pubDate, found := pickJATSDate(articleMeta.PubDates)
+	if found {
+		dateType := pubDate.PubType
+		if dateType == "" {
+			dateType = pubDate.DateType
+		}
+		tempJSON.Date, _ = normaliseDate("nxml:"+dateType, pubDate.Year, pubDate.Month, pubDate.Day)
 	}
-	//log.Print(pubMedMetadata)
 
-	return &pubMedMetadata, nil
+	for _, contrib := range articleMeta.Contribs {
+		if contrib.ContribType != "author" {
+			continue
+		}
+		if contrib.Name.Surname != "" {
+			tempJSON.AuthorList = append(tempJSON.AuthorList, json_definitions.Author{
+				Surname:    strings.TrimSpace(contrib.Name.Surname),
+				GivenNames: strings.TrimSpace(contrib.Name.GivenNames),
+			})
+		} else if collab := contrib.Collab.String(); collab != "" {
+			tempJSON.AuthorList = append(tempJSON.AuthorList, json_definitions.Author{
+				Collab: collab,
+			})
+		}
+	}
+
+	// The license the OA service reports replaces this one later on, but it
+	// is not always there. The URL of the license says more than its type.
+	for _, license := range articleMeta.Licenses {
+		articleLicense := strings.TrimSpace(license.Href)
+		if articleLicense == "" {
+			articleLicense = strings.TrimSpace(license.LicenseType)
+		}
+		if articleLicense != "" {
+			tempJSON.License = &articleLicense
+			break
+		}
+	}
+
+	return &tempJSON, nil
+}
+
+// pickJATSDate returns the publication date of a JATS article, preferring the
+// electronic one.
+func pickJATSDate(pubDates []xml_definitions.JATSPubDate) (xml_definitions.JATSPubDate, bool) {
+	for _, preferred := range jatsDatePreference {
+		for _, pubDate := range pubDates {
+			dateType := pubDate.PubType
+			if dateType == "" {
+				dateType = pubDate.DateType
+			}
+			if dateType == preferred && pubDate.Year != "" {
+				return pubDate, true
+			}
+		}
+	}
+	for _, pubDate := range pubDates {
+		if pubDate.Year != "" {
+			return pubDate, true
+		}
+	}
+	return xml_definitions.JATSPubDate{}, false
 }
 
-func downloadIDXML(url string) (*xml_definitions.PCMIDSet, error) {
-	// Download the data.
-	urlResponse, err := http.Get(url)
+func extractArticle(archivePath string, destination string, pmcid string) error {
+	// Anything already in the article's own folder is left over from an
+	// extraction that was interrupted, so clear it out first. The destination
+	// itself is shared with other articles that have the same hashes.
+	err := os.RemoveAll(path.Join(destination, pmcid))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	defer urlResponse.Body.Close()
-	//log.Print(url)
+	// The download was complete, so a package that cannot be extracted is
+	// broken on the server and retrying will not help.
+	err = new(getter.TarGzipDecompressor).Decompress(destination, archivePath, true, 0)
+	if err != nil {
+		log.Print("Error extracting article. See error below:")
+		return &permanentError{Err: err}
+	}
+	os.Remove(archivePath)
+	return nil
+}
 
-	// Read the data to a []char.
-	dataString, err := ioutil.ReadAll(urlResponse.Body)
+// printRecordDownloads lists what a dry run would download, one line for
+// each file.
+func printRecordDownloads(recordList []record, policy formatPolicy) {
+	for _, currentRecord := range recordList {
+		for _, link := range policy.selectLinks(currentRecord.Links) {
+			fmt.Println(currentRecord.ID + "\t" + link.Updated + "\t" + link.Href)
+		}
+	}
+}
+
+// markArticleFailed moves an article to the failed state in the journal and
+// adds it to the bad listing.
+func markArticleFailed(journal *progressJournal, badArticleListing *os.File, articleRecord record, reason string) error {
+	err := journal.Record(articleRecord.ID, articleRecord.Link.Updated, stateFailed, reason)
 	if err != nil {
-		log.Print("Error reading the metadata file.")
-		return nil, err
+		return err
 	}
+	return writeBadArticle(badArticleListing, articleRecord.ID, reason)
+}
 
-	// Parse the XML data.
-	pubMedMetadata := xml_definitions.PCMIDSet{}
-	err = xml.Unmarshal(dataString, &pubMedMetadata)
+// writeBadArticle records an article that could not be downloaded along with
+// the reason why, as its first attempt. retry-bad adds up the attempts of
+// an article that fails more than once.
+func writeBadArticle(badArticleListing *os.File, pmcid string, reason string) error {
+	attemptTime := time.Now().Format(time.RFC3339)
+	entry := badArticle{PMCID: pmcid, Reason: reason, Attempts: 1, FirstSeen: attemptTime, LastAttempt: attemptTime}
+	_, err := badArticleListing.WriteString(entry.String() + "\n")
 	if err != nil {
-		log.Print("issue unmarshalling id metadata")
-		log.Print(err)
-		return nil, err
+		log.Print("Issue getting metadata of and saving reference to: " + pmcid)
 	}
-	//log.Print(pubMedMetadata)
+	return err
+}
 
-	return &pubMedMetadata, nil
+// The number of IDs sent to the ID converter and to efetch in one request.
+const idconvBatchSize = 200
+const efetchBatchSize = 200
+
+// batchRecords splits recordList into batches of at most batchSize records.
+func batchRecords(recordList []record, batchSize int) [][]record {
+	batches := [][]record{}
+	for start := 0; start < len(recordList); start += batchSize {
+		end := start + batchSize
+		if end > len(recordList) {
+			end = len(recordList)
+		}
+		batches = append(batches, recordList[start:end])
+	}
+	return batches
+}
+
+// batchStrings splits ids into batches of at most batchSize IDs.
+func batchStrings(ids []string, batchSize int) [][]string {
+	batches := [][]string{}
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batches = append(batches, ids[start:end])
+	}
+	return batches
 }
 
-func downloadArticles(lastTime time.Time, updateURLBase string, articleBasePath string, metadataBasePath string, articleListing *os.File, emailAddress string, badArticleListing *os.File) error {
+// indexIDRecords returns the ID converter answers for a batch keyed by the
+// PMCID they answer. Answers for IDs that were not asked about, and any after
+// the first for the same ID, are logged and dropped.
+func indexIDRecords(currentBatch []record, idRecords []xml_definitions.Record) map[string]xml_definitions.Record {
+	requested := make(map[string]bool, len(currentBatch))
+	for _, currentRecord := range currentBatch {
+		requested[currentRecord.ID] = true
+	}
+	indexed := make(map[string]xml_definitions.Record, len(idRecords))
+	for _, idRecord := range idRecords {
+		requestedID := idRecord.RequestID
+		if requestedID == "" {
+			requestedID = idRecord.PMCID
+		}
+		if !requested[requestedID] {
+			log.Print("Ignoring ID converter answer for " + requestedID + " which was not asked about.")
+			continue
+		}
+		if _, duplicate := indexed[requestedID]; duplicate {
+			log.Print("Ignoring repeated ID converter answer for " + requestedID)
+			continue
+		}
+		indexed[requestedID] = idRecord
+	}
+	return indexed
+}
 
+// indexPubmedArticles adds the articles efetch returned for a batch of PMIDs
+// to metadataByPMID. Articles that were not asked for are logged and dropped.
+func indexPubmedArticles(currentBatchPMIDs []string, pubmedArticleList []xml_definitions.PubmedArticle, metadataByPMID map[string]*xml_definitions.PubmedArticle) {
+	requested := make(map[string]bool, len(currentBatchPMIDs))
+	for _, pmid := range currentBatchPMIDs {
+		requested[pmid] = true
+	}
+	for tempArticle := range pubmedArticleList {
+		pmid := strings.TrimSpace(pubmedArticleList[tempArticle].MedlineCitation.PMID.PMID)
+		if !requested[pmid] {
+			log.Print("Ignoring PubMed metadata for PMID " + pmid + " which was not asked for.")
+			continue
+		}
+		if _, duplicate := metadataByPMID[pmid]; duplicate {
+			log.Print("Ignoring repeated PubMed metadata for PMID " + pmid)
+			continue
+		}
+		metadataByPMID[pmid] = &pubmedArticleList[tempArticle]
+	}
+}
+
+// pubmedPMCIDMatches reports whether the PubMed record agrees that it is
+// about the article with the given PMCID. Records that do not list a PMCID
+// are given the benefit of the doubt.
+func pubmedPMCIDMatches(metadata *xml_definitions.PubmedArticle, pmcid string) bool {
+	for _, articleID := range metadata.PubmedData.ArticleIDList {
+		if articleID.IDType == "pmc" && strings.TrimSpace(articleID.ID) != pmcid {
+			return false
+		}
+	}
+	return true
+}
+
+// processRecords takes a list of OA records through ID conversion, metadata
+// download and article download, saving each finished article to the
+// listing. Failures are recorded in the bad listing and counted in runConfig.
+func (client *Client) processRecords(recordList []record, target *corpus, runConfig *config, concurrency int) error {
 	var err error
-	userInfo := "&tool=sciencefair_downloader&email=" + emailAddress
-	const metadataBaseLink = "https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?db=pubmed&retmode=XML&id="
-	const pmcidBaseLink = "https://www.ncbi.nlm.nih.gov/pmc/utils/idconv/v1.0/?versions=no&idtype=pmcid&ids="
-	lastTimeFormatted := lastTime.Format("2006-01-02+15:04:05")
-	log.Print("lastTime=" + lastTimeFormatted)
-	formatURL := "&format=tgz"
-	fullUpdateURL := updateURLBase + lastTimeFormatted + formatURL
-	log.Print(fullUpdateURL)
-	// If there is anything in the article list download them.
-	// Continue until the resumption link is nil.
-	var updateComplete = false
-	//getterClient := &getter.Client{}
-	var numNewArticles int
-	for updateComplete != true {
-		var updateXML []byte
-		updateXML, err = downloadUpdateXML(fullUpdateURL)
+	userInfo := client.userInfo()
+	policy, err := parseFormatPolicy(runConfig.Formats)
+	if err != nil {
+		return err
+	}
+	requiredIdentifiers, err := parseIdentifierPolicy(runConfig.RequiredIdentifiers)
+	if err != nil {
+		return err
+	}
+	journal := target.Journal
+	badArticleListing := target.BadArticleListing
+	numNewArticles := len(recordList)
+
+	// We now need to do the following things to make sure we have the right
+	// data:
+	// Go through the loop once and separate the PMCID data into 200 article
+	// chunks. Those will then be fed into this system:
+	// https://www.ncbi.nlm.nih.gov/pmc/tools/id-converter-api/
+	// Probably with the:
+	// service-root?ids=PMC1193645&versions=no,
+	// service-root?ids=PMC2883744&format=json
+	// settings so that we get it as JSON, and so that we only get the most
+	// recent version.
+	// Go through the new list of PMID values and download their metadata in
+	// batches of 200.
+	// Once this is finally complete, begin downloading and saving the
+	// actual papers and once each paper is downloaded save its metadata file
+	// and add the info to the listing.
+
+	// Current limits of 3 requests per second.
+	PMCIDList := []record{}
+	// Create a slice of record structs.
+	for PMCID := 0; PMCID < numNewArticles; PMCID++ {
+		currentRecord := recordList[PMCID]
+		// Skip articles that are not offered in any of the wanted formats.
+		if !policy.selectFormats(&currentRecord) {
+			continue
+		}
+		// A link that cannot be downloaded will not get any better.
+		err = checkLinks(currentRecord)
 		if err != nil {
 			log.Print(err)
-			return err
+			runConfig.BadArticles++
+			err = markArticleFailed(journal, badArticleListing, currentRecord, "LinkError")
+			if err != nil {
+				return err
+			}
+			continue
 		}
 
-		var update databaseUpdate
-		xml.Unmarshal(updateXML, &update)
-		//log.Print(update)
-		if update.Records.Resumption == nil {
-			updateComplete = true
-		} else {
-			// TODO: Swap this back to fullUpdateURL when it is working
-			// so it will actually download everything.
-			updateComplete = true
-			//fullUpdateURL = update.Records.Resumption.ResumptionLink.Href
+		// Skip articles that an earlier, interrupted attempt at this page
+		// already finished with.
+		if journal.Reached(currentRecord.ID, currentRecord.Link.Updated, stateIndexed) {
+			continue
 		}
-		numNewArticles, err = strconv.Atoi(update.Records.ReturnedCount)
+
+		// Skip articles whose stored version is already this one. Any other
+		// version in the index is replaced once the new one is downloaded.
+		indexed, found, err := target.Index.ByPMCID(currentRecord.ID)
 		if err != nil {
-			log.Print("Issue discovering the number of articles to download. Terminating...")
+			log.Print("issue looking up " + currentRecord.ID + " in the article index")
 			return err
 		}
-		if numNewArticles <= 0 {
-			log.Print("Somehow there were no new articles in this file. Terminating...")
+		if found && indexed.Updated == currentRecord.Link.Updated {
+			continue
+		}
+		if found && indexed.Updated != "" {
+			log.Print(currentRecord.ID + " was updated on " + currentRecord.Link.Updated +
+				", replacing revision " + strconv.Itoa(indexed.Revision) + " from " + indexed.Updated)
+		}
+		err = journal.Advance(currentRecord.ID, currentRecord.Link.Updated, stateDiscovered, "")
+		if err != nil {
 			return err
 		}
 
-		// We now need to do the following things to make sure we have the right
-		// data:
-		// Go through the loop once and separate the PMCID data into 200 article
-		// chunks. Those will then be fed into this system:
-		// https://www.ncbi.nlm.nih.gov/pmc/tools/id-converter-api/
-		// Probably with the:
-		// service-root?ids=PMC1193645&versions=no,
-		// service-root?ids=PMC2883744&format=json
-		// settings so that we get it as JSON, and so that we only get the most
-		// recent version.
-		// Go through the new list of PMID values and download their metadata in
-		// batches. The metadata search can handle 500 artilces at a time.
-		// Once this is finally complete, begin downloading and saving the
-		// actual papers and once each paper is downloaded save its metadata file
-		// and add the info to the listing.
-
-		// Current limits of 3 requests per second.
-		PMCIDList := []record{}
-		// Create a slice of record structs.
-		for PMCID := 0; PMCID < numNewArticles; PMCID++ {
-			if update.Records.RecordList[PMCID].Link.Format == "pdf" {
-				continue
-			}
+		PMCIDList = append(PMCIDList, currentRecord)
+	}
 
-			// This means it is not a pdf entry.
-			PMCIDList = append(PMCIDList, update.Records.RecordList[PMCID])
+	// Records with a PMID go on to have their PubMed metadata downloaded,
+	// and the rest have it read from their NXML later. Articles the ID
+	// converter has no good answer for, or whose PMID belongs to another
+	// article, go to the bad listing instead.
+	pubmedRecordList := make([]record, 0)
+	pubmedIDList := make([]xml_definitions.Record, 0)
+	noPMIDRecordList := make([]record, 0)
+	noPMIDIDList := make([]xml_definitions.Record, 0)
+	claimedPMIDs := make(map[string]string)
+	sortIDRecord := func(currentRecord record, idRecord xml_definitions.Record, missingReason string) error {
+		if missingReason == "" {
+			missingReason = requiredIdentifiers.missingIdentifier(idRecord)
 		}
 
-		// Make a copy of the slice  and then make batches of it.
-		copyPMCIDList := make([]record, len(PMCIDList))
-		copy(copyPMCIDList, PMCIDList)
-		var numBatches = len(PMCIDList) / 200.0
-
-		PMCIDBatches := [][]record{}
-		var singleBatch []record
-
-		// Deal with all but the last batch.
-		if numBatches > 1 {
-			for i := 0; i < numBatches-1; i++ {
-				singleBatch, copyPMCIDList = copyPMCIDList[:200], copyPMCIDList[200:]
-				PMCIDBatches = append(PMCIDBatches, singleBatch)
+		// Two PMCIDs that PubMed links to the same PMID cannot both be
+		// stored under it, so the article already indexed, or the first
+		// one seen, keeps it.
+		if missingReason == "" && idRecord.PMID != "" {
+			claimant, claimed := claimedPMIDs[idRecord.PMID]
+			if !claimed {
+				indexed, found, err := target.Index.Get(idRecord.PMID)
+				if err != nil {
+					log.Print("issue looking up " + idRecord.PMID + " in the article index")
+					return err
+				}
+				claimant, claimed = indexed.PMCID, found
+			}
+			if claimed && claimant != currentRecord.ID {
+				log.Print(currentRecord.ID + " has PMID " + idRecord.PMID + ", which already belongs to " + claimant)
+				missingReason = "PMIDConflict"
+			} else {
+				claimedPMIDs[idRecord.PMID] = currentRecord.ID
 			}
 		}
-		// Deal with the last batch.
-		PMCIDBatches = append(PMCIDBatches, copyPMCIDList)
-		//log.Print(PMCIDBatches)
-
-		// Step through batches and download the ID conversion data and links.
-		// If there is an issue with the ID conversion data, don't download it and
-		// add it to the badPMCIDList.
-		// Otherwise, add the PMCID to finalPMCIDList, the record struct to
-		// finalPMCRecordList the ID conversion
-		// data to fullPMIDList, the PMID to totalPMIDList, and the PMID
-		// to totalPMIDList.
 
-		totalPMIDList := make([]string, 0)
-		fullPMIDList := make([]xml_definitions.Record, 0)
+		if missingReason != "" {
+			runConfig.BadArticles++
+			return markArticleFailed(journal, badArticleListing, currentRecord, missingReason)
+		}
+		if idRecord.PMID == "" {
+			// PubMed knows nothing about this article, so its metadata is
+			// read from its NXML once it has been downloaded.
+			noPMIDRecordList = append(noPMIDRecordList, currentRecord)
+			noPMIDIDList = append(noPMIDIDList, idRecord)
+		} else {
+			pubmedRecordList = append(pubmedRecordList, currentRecord)
+			pubmedIDList = append(pubmedIDList, idRecord)
+		}
+		if journal.Reached(currentRecord.ID, currentRecord.Link.Updated, stateIDConverted) {
+			return nil
+		}
+		return journal.RecordIdentifiers(currentRecord.ID, currentRecord.Link.Updated, idRecord.PMID, idRecord.DOI)
+	}
 
-		finalPMCIDList := make([]string, 0)
-		finalPMCRecordList := make([]record, 0)
-		badPMCIDList := make([]string, 0)
+	// An interrupted run may already have converted some of the IDs, in
+	// which case the journal has the answers.
+	unconvertedList := make([]record, 0, len(PMCIDList))
+	for _, currentRecord := range PMCIDList {
+		identifiers, found := journal.Identifiers(currentRecord.ID, currentRecord.Link.Updated)
+		if !found {
+			unconvertedList = append(unconvertedList, currentRecord)
+			continue
+		}
+		idRecord := xml_definitions.Record{
+			RequestID: currentRecord.ID,
+			PMCID:     currentRecord.ID,
+			PMID:      identifiers.PMID,
+			DOI:       identifiers.DOI,
+		}
+		err = sortIDRecord(currentRecord, idRecord, "")
+		if err != nil {
+			return err
+		}
+	}
 
-		for PMCIDBatch := 0; PMCIDBatch < len(PMCIDBatches); PMCIDBatch++ {
-			currentBatch := PMCIDBatches[PMCIDBatch]
-			PMCIDString := []string{}
-			for i := 0; i < len(currentBatch); i++ {
-				PMCIDString = append(PMCIDString, currentBatch[i].ID)
-			}
-			metadataPCMID := strings.Join(PMCIDString[:], ",")
+	// Step through batches and download the ID conversion data. The answers
+	// are matched to the records by PMCID rather than by position, since the
+	// service does not promise to answer in the order it was asked.
+	// If there is an issue with the ID conversion data, don't download it and
+	// add it to the bad listing.
+	for _, currentBatch := range batchRecords(unconvertedList, idconvBatchSize) {
+		PMCIDString := []string{}
+		for i := 0; i < len(currentBatch); i++ {
+			PMCIDString = append(PMCIDString, currentBatch[i].ID)
+		}
+		metadataPCMID := strings.Join(PMCIDString[:], ",")
 
-			// Download the PCMIDSet data.
-			pmidDataURL := pmcidBaseLink + metadataPCMID + userInfo
-			var articlePMIDData *xml_definitions.PCMIDSet
-			articlePMIDData, err = downloadIDXML(pmidDataURL)
-			//log.Print(articlePMIDData)
-			if err != nil {
+		// Download the PCMIDSet data.
+		pmidDataURL := client.PMCIDBaseLink + metadataPCMID + userInfo
+		var articlePMIDData *xml_definitions.PCMIDSet
+		articlePMIDData, err = client.downloadIDXML(pmidDataURL)
+		//log.Print(articlePMIDData)
+		if err != nil {
+			if isRetryable(err) {
 				return err
 			}
-
-			tempRecords := articlePMIDData.Records
-			for i := 0; i < len(tempRecords); i++ {
-				if tempRecords[i].PMID == "" {
-					//log.Print(tempRecords[i])
-					badPMCIDList = append(badPMCIDList, tempRecords[i].PMCID)
-					_, err = badArticleListing.WriteString(tempRecords[i].PMCID + "," + "PMIDError" + "\n")
-					if err != nil {
-						log.Print("Issue getting metadata of and saving reference to: " + tempRecords[i].PMCID)
-						continue
-					}
-				} else if tempRecords[i].DOI == "" {
-					//log.Print(tempRecords[i])
-					badPMCIDList = append(badPMCIDList, tempRecords[i].PMCID)
-					_, err = badArticleListing.WriteString(tempRecords[i].PMCID + "," + "DOIError" + "\n")
-					if err != nil {
-						log.Print("Issue getting metadata of and saving reference to: " + tempRecords[i].PMCID)
-						continue
-					}
-				} else {
-					finalPMCIDList = append(finalPMCIDList, tempRecords[i].PMCID)
-					finalPMCRecordList = append(finalPMCRecordList, currentBatch[i])
-					fullPMIDList = append(fullPMIDList, tempRecords[i])
-					totalPMIDList = append(totalPMIDList, tempRecords[i].PMID)
-
+			// The service gave an answer that will not change if we ask
+			// again, so set this batch aside and carry on with the rest.
+			for i := 0; i < len(currentBatch); i++ {
+				runConfig.BadArticles++
+				err = markArticleFailed(journal, badArticleListing, currentBatch[i], "IDConvError")
+				if err != nil {
+					return err
 				}
 			}
+			continue
 		}
 
-		copyTotalPMIDList := make([]string, len(totalPMIDList))
-		copy(copyTotalPMIDList, totalPMIDList)
-		numBatches = len(totalPMIDList) / 200.0
-
-		PMIDBatches := [][]string{}
-		var singlePMIDBatch []string
-		// Deal with all but the last batch.
-		if numBatches > 1 {
-			for i := 0; i < numBatches-1; i++ {
-				singlePMIDBatch, copyTotalPMIDList = copyTotalPMIDList[:200], copyTotalPMIDList[200:]
-				PMIDBatches = append(PMIDBatches, singlePMIDBatch)
+		idRecords := indexIDRecords(currentBatch, articlePMIDData.Records)
+		for _, currentRecord := range currentBatch {
+			idRecord, found := idRecords[currentRecord.ID]
+			missingReason := ""
+			switch {
+			case !found:
+				log.Print("The ID converter did not answer for " + currentRecord.ID)
+				missingReason = "IDConvMissing"
+			case idRecord.Status == "error":
+				log.Print("ID conversion of " + currentRecord.ID + " failed: " + idRecord.ErrMsg)
+				missingReason = "IDConvError"
+			case idRecord.PMCID != currentRecord.ID:
+				log.Print("The ID converter answered for " + idRecord.PMCID + " when asked about " + currentRecord.ID)
+				missingReason = "IDConvMismatch"
+			}
+			err = sortIDRecord(currentRecord, idRecord, missingReason)
+			if err != nil {
+				return err
 			}
 		}
-		// Deal with the last batch.
-		PMIDBatches = append(PMIDBatches, copyTotalPMIDList)
-
-		// Step through batches and download the metadata an links.
-		totalPubmedArticleList := make([]*xml_definitions.PubmedArticle, 0)
+	}
 
-		for PMIDBatch := 0; PMIDBatch < len(PMIDBatches); PMIDBatch++ {
-			// Download metadata.
-			currentBatchPMIDs := PMIDBatches[PMIDBatch]
-			metadataPMID := strings.Join(currentBatchPMIDs[:], ",")
-			metaDataURL := metadataBaseLink + metadataPMID + userInfo
-			//log.Print("test1")
-			var articleMetadata *xml_definitions.PubmedArticleSet
-			articleMetadata, err = downloadMetaDataXML(metaDataURL)
-			if err != nil {
+	// Step through batches of PMIDs and download the metadata. Again the
+	// answers are matched up by PMID since efetch can reorder or leave out
+	// articles.
+	totalPMIDList := make([]string, 0, len(pubmedIDList))
+	for _, idRecord := range pubmedIDList {
+		totalPMIDList = append(totalPMIDList, idRecord.PMID)
+	}
+	metadataByPMID := make(map[string]*xml_definitions.PubmedArticle)
+	failedPMIDs := make(map[string]bool)
+
+	for _, currentBatchPMIDs := range batchStrings(totalPMIDList, efetchBatchSize) {
+		// Download metadata.
+		metadataPMID := strings.Join(currentBatchPMIDs[:], ",")
+		metaDataURL := client.MetadataBaseLink + metadataPMID + userInfo
+		var articleMetadata *xml_definitions.PubmedArticleSet
+		articleMetadata, err = client.downloadMetaDataXML(metaDataURL)
+		if err != nil {
+			if isRetryable(err) {
 				return err
 			}
-			pubmedArticleList := *articleMetadata.PubmedArticles
-			for tempArticle := 0; tempArticle < len(pubmedArticleList); tempArticle++ {
-				totalPubmedArticleList = append(totalPubmedArticleList, &pubmedArticleList[tempArticle])
+			// The articles in this batch are sent to the bad listing below.
+			log.Print("Unable to use metadata batch, skipping its articles.")
+			for _, pmid := range currentBatchPMIDs {
+				failedPMIDs[pmid] = true
 			}
+			continue
 		}
+		indexPubmedArticles(currentBatchPMIDs, *articleMetadata.PubmedArticles, metadataByPMID)
+	}
 
-		numNewArticles = len(finalPMCIDList)
-
-		for currentArticle := 0; currentArticle < numNewArticles; currentArticle++ {
-			//log.Print(update.Records.RecordList)
-			/*
-				if update.Records.RecordList[currentArticle].Link.Format == "pdf" {
-					continue
-				}
-				articleLinkFtp := update.Records.RecordList[currentArticle].Link.Href
-			*/
-			articleLinkFtp := finalPMCRecordList[currentArticle].Link.Href
-			// Process the link to find the hashed directory names.
-			articleList := strings.SplitN(articleLinkFtp, "/", 3)
-			// No longer need this next line since we download everything above.
-			//metadataPMID := strings.Split(strings.Split(articleLinkFtp, "PMC")[1], ".")[0]
-			//log.Print(articleList)
-			articleLinkHTTP := "http://" + articleList[2]
-			articleListHashes := strings.Split(articleList[2], "/")
-			firstHash := articleListHashes[4]
-			secondHash := articleListHashes[5]
-
-			articleDestination := []string{
-				articleBasePath,
-				firstHash,
-				secondHash,
-			}
-			articlePath := path.Join(articleDestination...)
-			err = downloadArticle(articleLinkHTTP, articlePath)
+	// Download the articles in parallel and save each one to the
+	// listing as it finishes.
+	articleJobs := make([]articleJob, 0, len(pubmedRecordList)+len(noPMIDRecordList))
+	for currentArticle, currentRecord := range pubmedRecordList {
+		idRecord := pubmedIDList[currentArticle]
+		metadata, found := metadataByPMID[idRecord.PMID]
+		missingReason := ""
+		switch {
+		case failedPMIDs[idRecord.PMID]:
+			missingReason = "MetadataError"
+		case !found:
+			log.Print("PubMed did not return metadata for PMID " + idRecord.PMID + " of " + currentRecord.ID)
+			missingReason = "MetadataMissing"
+		case !pubmedPMCIDMatches(metadata, currentRecord.ID):
+			log.Print("PubMed links PMID " + idRecord.PMID + " to a different article than " + currentRecord.ID)
+			missingReason = "MetadataMismatch"
+		}
+		if missingReason != "" {
+			runConfig.BadArticles++
+			err = markArticleFailed(journal, badArticleListing, currentRecord, missingReason)
 			if err != nil {
-				log.Fatal(err)
 				return err
 			}
+			continue
+		}
+		articleJobs = append(articleJobs, articleJob{
+			Record:   currentRecord,
+			IDRecord: idRecord,
+			Metadata: metadata,
+		})
+	}
+	for currentArticle := range noPMIDRecordList {
+		articleJobs = append(articleJobs, articleJob{
+			Record:   noPMIDRecordList[currentArticle],
+			IDRecord: noPMIDIDList[currentArticle],
+		})
+	}
+	err = client.downloadArticlePool(articleJobs, concurrency, target.Layout, target.Index, target.Journals, badArticleListing, journal, func(savedJob articleJob) {
+		runConfig.ArticlesProcessed++
+	}, func(failedJob articleJob) {
+		runConfig.BadArticles++
+	})
+	// Keep the journals of whatever was saved, even if the run stopped early.
+	saveErr := target.Journals.Save()
+	if err != nil {
+		return err
+	}
+	if saveErr != nil {
+		return saveErr
+	}
 
-			// Download and save the article metadata using:
-			// https://www.ncbi.nlm.nih.gov/pmc/tools/get-metadata/
-			// Specifically:
-			// https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?db=pubmed&id=PMID
-			// Where PMID is the PMID of the article.
-
-			hashPath := path.Join(firstHash, secondHash)
-			/*
-				// No longer use this because we downloaded this information before.
-				metaDataURL := metadataBaseLink + metadataPMID + userInfo
-				articleMetadata, err := downloadMetaDataXML(metaDataURL)
-				if err != nil {
-					return err
-				}
+	return nil
+}
 
-				// Convert the downloaded data to the sciencefair JSON format.
-				// Start by filling in the defaults for this repository.
-				//log.Print(articleMetadata)
-				if articleMetadata == nil {
+// downloadArticles walks every page of the OA service for the records
+// updated in the range given by options and processes them. Progress is
+// committed to config.json and the update checkpoint after each page.
+func (client *Client) downloadArticles(target *corpus, runConfig *config, options syncOptions) error {
 
-				}
-				singleArticle := *articleMetadata.PubmedArticles
-			*/
-			singleArticle := totalPubmedArticleList[currentArticle]
-			metadataJSON, err := convertXMLToJSON(singleArticle, hashPath, &fullPMIDList[currentArticle].DOI, finalPMCIDList[currentArticle])
-			if err != nil {
-				log.Print("issue converting xml to json")
-				return err
-			}
-			metadataString, err := json.Marshal(metadataJSON)
-			if err != nil {
-				log.Print("issue marshalling to json")
-			}
+	var err error
+	// The OA service takes its range in NCBI time.
+	lastTimeFormatted := options.From.In(ncbiLocation).Format("2006-01-02+15:04:05")
+	log.Print("lastTime=" + lastTimeFormatted)
+	var untilFormatted string
+	untilURL := ""
+	if !options.Until.IsZero() {
+		untilFormatted = options.Until.In(ncbiLocation).Format("2006-01-02+15:04:05")
+		untilURL = "&until=" + untilFormatted
+	}
+	policy, err := parseFormatPolicy(runConfig.Formats)
+	if err != nil {
+		return err
+	}
+	formatURL := policy.formatParameter()
+	fullUpdateURL := client.UpdateURLBase + lastTimeFormatted + untilURL + formatURL
+	pageNumber := 1
+	checkpointPath := options.CheckpointPath
+	configPath := target.Layout.ConfigPath
+
+	// If a previous run over the same range was interrupted, resume from the
+	// page it was working on.
+	checkpoint, err := readCheckpoint(checkpointPath)
+	if err == nil && !options.DryRun && checkpoint.From == lastTimeFormatted && checkpoint.Until == untilFormatted && checkpoint.PageURL != "" {
+		fullUpdateURL = checkpoint.PageURL
+		pageNumber = checkpoint.PageNumber
+		log.Print("Resuming interrupted update at page " + strconv.Itoa(pageNumber))
+	}
+	// Only start a fresh watermark when this is not a continuation of an
+	// interrupted run, otherwise records updated while the first attempt was
+	// running could be missed by the next sync.
+	if options.Concurrency <= 0 {
+		options.Concurrency = runConfig.Concurrency
+	}
+	if pageNumber == 1 || runConfig.RunStarted == "" {
+		runConfig.RunStarted = time.Now().In(ncbiLocation).Add(-watermarkOverlap).Format("20060102150405")
+		runConfig.PagesProcessed = 0
+		runConfig.ArticlesProcessed = 0
+		runConfig.BadArticles = 0
+	}
+	log.Print(redactURL(fullUpdateURL))
+	// If there is anything in the article list download them.
+	// Continue until the resumption link is nil.
+	var updateComplete = false
+	for updateComplete != true {
+		var update *databaseUpdate
+		update, err = client.downloadUpdatePage(fullUpdateURL)
+		if err != nil {
+			log.Print(err)
+			return err
+		}
 
-			// Save the metadata string to a json file.
-			// Use name PubMedCentral-PMID-v2.json
-			metadataDestination := []string{
-				metadataBasePath,
-				firstHash,
-				secondHash,
+		var nextUpdateURL string
+		if update.Records.Resumption == nil || update.Records.Resumption.ResumptionLink.Href == "" {
+			updateComplete = true
+		} else {
+			nextUpdateURL = update.Records.Resumption.ResumptionLink.Href
+		}
+		log.Print("Processing update page " + strconv.Itoa(pageNumber))
+		// The records are what counts. returned-count is only checked
+		// against them.
+		returnedCount, countErr := strconv.Atoi(update.Records.ReturnedCount)
+		if countErr != nil || returnedCount != len(update.Records.RecordList) {
+			log.Print("The page says it has " + update.Records.ReturnedCount + " records but holds " +
+				strconv.Itoa(len(update.Records.RecordList)) + ", using the ones it holds.")
+		}
+		if len(update.Records.RecordList) == 0 {
+			// Nothing changed in this window, which still completes the page.
+			log.Print("There are no records on this page.")
+		}
+
+		if options.DryRun {
+			// Only report what would be downloaded.
+			printRecordDownloads(update.Records.RecordList, policy)
+			if updateComplete {
+				break
 			}
+			pageNumber++
+			fullUpdateURL = nextUpdateURL
+			continue
+		}
 
-			// Create the path to the json file.
-			metadataPath := path.Join(metadataDestination...)
+		err = client.processRecords(update.Records.RecordList, target, runConfig, options.Concurrency)
+		if err != nil {
+			return err
+		}
 
-			err = os.MkdirAll(metadataPath, 0655)
+		// Commit the watermark for this page. Once the last page is done the
+		// start of this run becomes the from= value of the next one. A
+		// backfill of an older range leaves the watermark alone.
+		runConfig.PagesProcessed++
+		if options.UpdateWatermark {
+			if updateComplete {
+				runConfig.LastDate = runConfig.RunStarted
+			}
+			err = saveJSON(runConfig, configPath)
 			if err != nil {
-				log.Print("issue creating directories for metadata files")
+				log.Print("issue saving sync watermark")
 				return err
 			}
+		}
 
-			metadataFileName := path.Join(metadataPath, "PubMedCentral-"+metadataJSON.Identifier[0].ID+"-v2.json")
-			err = ioutil.WriteFile(metadataFileName, metadataString, 0655)
+		// Everything on this page has been saved, so record where the next
+		// run should pick up if this one is interrupted.
+		if updateComplete {
+			err = clearCheckpoint(checkpointPath)
 			if err != nil {
-				log.Print("issue saving metadata json file")
+				log.Print("issue removing update checkpoint")
 				return err
 			}
-
-			// Save the following to articleListing:
-			// key, value1, value2 sets on each line of
-			// KEY = ARTICLE_IDENTIFIER (PMID)
-			// VALUE1 = PATH_TO_ARTICLE (Same path as articlePath)
-			// VALUE2 = TIME_OF_ARTICLE_UPDATE (Found in the article metadata.)
-			// VALUE3 = PMCID
-			// VALUE4 = DOI
-			csvData := metadataJSON.Identifier[0].ID + "," + firstHash +
-				"/" + secondHash + "," + metadataJSON.Date.Year +
-				metadataJSON.Date.Month + metadataJSON.Date.Day + "," +
-				fullPMIDList[currentArticle].PMCID + "," +
-				fullPMIDList[currentArticle].DOI +
-				"\n"
-			_, err = articleListing.WriteString(csvData)
+		} else {
+			pageNumber++
+			fullUpdateURL = nextUpdateURL
+			err = saveCheckpoint(&updateCheckpoint{
+				From:       lastTimeFormatted,
+				Until:      untilFormatted,
+				PageURL:    fullUpdateURL,
+				PageNumber: pageNumber,
+			}, checkpointPath)
 			if err != nil {
-				log.Print("issue writing to csv index")
+				log.Print("issue saving update checkpoint")
 				return err
 			}
 		}
@@ -614,120 +1143,155 @@ func downloadArticles(lastTime time.Time, updateURLBase string, articleBasePath
 	return nil
 }
 
-func main() {
-	// Read the oa_files folder to see if there is a previously downloaded
-	// listing.
-	pwd, _ := os.Getwd()
-	pwd = path.Join(pwd, "PMCData")
-	articleBasePath := path.Join(pwd, "articles")
-	metadataBasePath := path.Join(pwd, "metadata")
-	oafilesPath := path.Join(pwd, "oa_files")
-	configPath := path.Join(pwd, "config.json")
-	articleListingPath := path.Join(oafilesPath, "article_listing.csv")
-	badArticleListingPath := path.Join(oafilesPath, "bad_article_listing.csv")
-	//log.Print(articleListingPath)
-	//var firstRun bool
-	//firstRun = false
-	var err error
-	lastConfig, err := readJSON(configPath)
+// corpus holds the layout and open files a sync writes into.
+type corpus struct {
+	Layout *layout
+
+	Index             *articleIndex
+	Journals          *journalRegistry
+	BadArticleListing *os.File
+	Journal           *progressJournal
+}
+
+// openCorpus opens the index, journal registry, bad listing and journal of
+// the corpus described by corpusLayout, creating them if this is the first
+// run. A corpus that still only has the old article listing has it imported
+// into a new index.
+func openCorpus(corpusLayout *layout) (*corpus, error) {
+	target := &corpus{Layout: corpusLayout}
+	oafilesPath := corpusLayout.OAFilesPath
+	indexPath := corpusLayout.IndexPath()
+	badArticleListingPath := corpusLayout.BadArticleListingPath()
+	journalPath := corpusLayout.JournalPath()
+
+	err := os.MkdirAll(oafilesPath, 0755)
 	if err != nil {
-		log.Print("uanble to load json file")
-		lastConfig = &config{}
+		log.Print("Unable to create oa_files folder.")
+		return nil, err
 	}
-	var files []os.FileInfo
-	files, err = ioutil.ReadDir(oafilesPath)
+
+	// Open the index that maps each article's PMID, PMCID and DOI to where
+	// it is stored.
+	_, err = os.Stat(indexPath)
+	newIndex := os.IsNotExist(err)
+	target.Index, err = openIndex(indexPath, false)
 	if err != nil {
-		log.Print("Unable to read oa_files. Creating folder.", err)
-		os.MkdirAll(oafilesPath, 0655)
-		files, err = ioutil.ReadDir(oafilesPath)
+		return nil, err
+	}
+	if newIndex {
+		imported, err := target.Index.importListing(corpusLayout.ArticleListingPath())
 		if err != nil {
-			log.Print("Still unable to create folder.")
-			panic(err)
+			target.Close()
+			os.Remove(indexPath)
+			return nil, err
+		}
+		if imported > 0 {
+			log.Print("Imported " + strconv.Itoa(imported) + " rows of the article listing into the index.")
 		}
 	}
 
-	// Check if any files were found.
-	//const initialURL = "http://ftp.ncbi.nlm.nih.gov/pub/pmc/oa_file_list.csv"
-	const updateURLBase = "https://www.ncbi.nlm.nih.gov/pmc/utils/oa/oa.fcgi?from="
-	currentTime := time.Now()
-	lastTime, err := time.Parse("20060102150405", lastConfig.LastDate)
+	target.Journals, err = openJournalRegistry(corpusLayout.JournalRegistryPath())
 	if err != nil {
-		log.Print("Unable to load last time. Assuming not dealing with updates.")
-		//lastTime = currentTime
-		lastTime, err = time.Parse("20060102150405", "20000101000000")
-		if err != nil {
-			log.Print("Issue parsing time.")
-			panic(err)
-		}
-	}
-	emailAddress := lastConfig.EmailAddress
-
-	// Open a csv file to place key, value1, value2 sets on each line of
-	// KEY = ARTICLE_IDENTIFIER
-	// VALUE1 = PATH_TO_ARTICLE
-	// VALUE2 = TIME_OF_ARTICLE_UPDATE
-	//if len(files) <= 0 || currentTime.Unix() > lastTime.Add(24*time.Hour).Unix() {
-	if len(files) <= 0 {
-		// Download new file.
-		//os.MkdirAll(path, perm)
-		//log.Print(articleListingPath)
-		articleListing, err := os.OpenFile(articleListingPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0655)
-		if err != nil {
-			log.Print("Issue opening or creating article listing file. Permission error?")
-			panic(err)
-		}
-		defer articleListing.Close()
+		target.Close()
+		return nil, err
+	}
 
-		badArticleListing, err := os.OpenFile(badArticleListingPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0655)
-		if err != nil {
-			log.Print("Issue opening or creating article listing file. Permission error?")
-			panic(err)
-		}
-		defer badArticleListing.Close()
+	target.BadArticleListing, err = os.OpenFile(badArticleListingPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0655)
+	if err != nil {
+		log.Print("Issue opening or creating article listing file. Permission error?")
+		target.Close()
+		return nil, err
+	}
 
-		log.Print("Downloading because we do not yet have a file.")
-		/*
-			err = downloadXML(initialURL)
-			if err != nil {
-				log.Print("Issue downloading the XML.", err)
-				return
-			}
-		*/
-		err = downloadArticles(lastTime, updateURLBase, articleBasePath, metadataBasePath, articleListing, emailAddress, badArticleListing)
-		if err != nil {
-			panic(err)
-		} else {
-			log.Print("No errors!")
-			return
-		}
-	} else if currentTime.Unix() > lastTime.Add(24*time.Hour).Unix() {
-		// NEW STUFF
-		tempPath := path.Join([]string{pwd, "oa_files", "article_listing.csv"}...)
-		articleListing, err := os.OpenFile(tempPath, os.O_RDWR|os.O_APPEND, 0655)
-		if err != nil {
-			log.Print("Issue opening article listing file. Permission error?")
-			panic(err)
-		}
-		defer articleListing.Close()
+	target.Journal, err = openJournal(journalPath)
+	if err != nil {
+		log.Print("Issue opening or creating the progress journal. Permission error?")
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
 
-		badArticleListing, err := os.OpenFile(badArticleListingPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0655)
-		if err != nil {
-			log.Print("Issue opening or creating article listing file. Permission error?")
-			panic(err)
-		}
-		defer badArticleListing.Close()
+func (target *corpus) Close() {
+	if target.Index != nil {
+		target.Index.Close()
+	}
+	if target.BadArticleListing != nil {
+		target.BadArticleListing.Close()
+	}
+	if target.Journal != nil {
+		target.Journal.Close()
+	}
+}
 
-		log.Print("Downloading because it has been more than 24 hours since last update.")
-		err = downloadArticles(lastTime, updateURLBase, articleBasePath, metadataBasePath, articleListing, emailAddress, badArticleListing)
-		if err != nil {
-			panic(err)
-		} else {
-			// TODO: Save the time this was started into the json file so that we
-			// can continue.
-			log.Print("Update complete!")
-		}
-	} else {
-		log.Print("No changes detected. Exiting...")
-		return
+// syncOptions describes a single run of downloadArticles.
+type syncOptions struct {
+	// Records updated from From up to Until are downloaded. A zero Until has
+	// no upper bound.
+	From  time.Time
+	Until time.Time
+	// Whether finishing the run moves last_date in config.json forward.
+	UpdateWatermark bool
+	// The number of articles to download at once. Zero uses the config.
+	Concurrency int
+	// Only list the records that would be downloaded.
+	DryRun bool
+	// Where to keep track of the page being worked on. Runs over different
+	// ranges need their own checkpoint so they do not resume each other.
+	CheckpointPath string
+}
+
+// ncbiLocation is the time zone of the times the OA service and the OA file
+// list give, and of the from= and until= they are asked with. None of them say
+// which zone they are in, but they are the local time of NCBI in Bethesda.
+// The watermark is kept in it too, so the start of a sync and the update
+// times a baseline takes from the file list can be compared as they are.
+var ncbiLocation = loadNCBILocation()
+
+func loadNCBILocation() *time.Location {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		log.Print("Unable to load the NCBI time zone, using Eastern Standard Time.")
+		return time.FixedZone("EST", -5*60*60)
+	}
+	return location
+}
+
+// How far before the start of a run its watermark is put. The overlap covers
+// records the OA service was still writing when the run asked for its first
+// page, along with any drift between the two clocks. Articles listed again
+// because of the overlap are already in the index and are skipped.
+const watermarkOverlap = time.Hour
+
+// lastSyncTime returns the time the last completed sync started, or the
+// start of the OA service's records if there has not been one.
+func lastSyncTime(runConfig *config) time.Time {
+	lastTime, err := time.ParseInLocation("20060102150405", runConfig.LastDate, ncbiLocation)
+	if err != nil {
+		log.Print("Unable to load last time. Assuming not dealing with updates.")
+		lastTime, _ = time.ParseInLocation("20060102150405", "20000101000000", ncbiLocation)
 	}
+	return lastTime
+}
+
+// runSync brings the corpus described by corpusLayout up to date with
+// everything updated since the last completed sync, moving the watermark in
+// runConfig forward as it goes. Only the concurrency and dry run settings of
+// options are used; the range always starts at the watermark.
+func runSync(client *Client, corpusLayout *layout, runConfig *config, options syncOptions) error {
+	target, err := openCorpus(corpusLayout)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	options.From = lastSyncTime(runConfig)
+	options.Until = time.Time{}
+	options.UpdateWatermark = !options.DryRun
+	options.CheckpointPath = corpusLayout.UpdateCheckpointPath()
+	return client.downloadArticles(target, runConfig, options)
+}
+
+func main() {
+	os.Exit(runCommand(os.Args[1:]))
 }
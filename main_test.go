@@ -0,0 +1,1543 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"./fake_ncbi"
+	"./json_definitions"
+	"./xml_definitions"
+)
+
+// newFakeClient returns a Client pointed at server that neither rate limits
+// nor waits between retries.
+func newFakeClient(server *fake_ncbi.Server) *Client {
+	client := NewClient("test@example.com", "")
+	client.UpdateURLBase = server.UpdateURLBase()
+	client.PMCIDBaseLink = server.PMCIDBaseLink()
+	client.MetadataBaseLink = server.MetadataBaseLink()
+	client.RecordURLBase = server.RecordURLBase()
+	client.FileListURL = server.FileListURL()
+	client.PackageBaseURL = server.PackageBaseURL()
+	client.HTTPClient = server.Client()
+	client.RetryPolicy = retryPolicy{MaxAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	return client
+}
+
+func readLines(t *testing.T, filePath string) []string {
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(contents)) == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSpace(string(contents)), "\n")
+}
+
+// readIndexedRows returns the index of the corpus as article listing rows.
+func readIndexedRows(t *testing.T, corpusLayout *layout) []string {
+	rows := []string{}
+	err := readIndex(corpusLayout, func(entry indexEntry) {
+		rows = append(rows, strings.Join(entry.listingFields(), ","))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestSyncAgainstFakeServer(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	runConfig := &config{}
+	err = runSync(newFakeClient(server), newLayout(dataRoot, layoutConfig{}), runConfig, syncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Three records over two pages of two.
+	if requests := server.Requests("/pmc/utils/oa/oa.fcgi"); requests != 2 {
+		t.Errorf("expected 2 OA service pages to be requested, got %d", requests)
+	}
+
+	listing := readIndexedRows(t, newLayout(dataRoot, layoutConfig{}))
+	// PMC1000003 has no PMID so it is listed by its PMCID.
+	expectedListing := map[string]bool{
+		"11000001,08/e0,20160615,PMC1000001,10.1000/jtb.2016.001":   true,
+		"11000002,1a/2b,20161100,PMC1000002,10.1000/tmj.2016.012":   true,
+		"PMC1000003,c3/d4,20170101,PMC1000003,10.1000/jtb.2017.003": true,
+	}
+	if len(listing) != len(expectedListing) {
+		t.Fatalf("expected %d listing rows, got %q", len(expectedListing), listing)
+	}
+	for _, row := range listing {
+		if !expectedListing[row] {
+			t.Errorf("unexpected listing row %q", row)
+		}
+	}
+
+	badListing := readLines(t, path.Join(dataRoot, "oa_files", "bad_article_listing.csv"))
+	if len(badListing) != 0 {
+		t.Errorf("unexpected bad listing %q", badListing)
+	}
+
+	_, err = os.Stat(path.Join(dataRoot, "articles", "08", "e0", "PMC1000001", "JTB-12-101.nxml"))
+	if err != nil {
+		t.Errorf("article package was not extracted: %v", err)
+	}
+
+	metadataBytes, err := ioutil.ReadFile(path.Join(dataRoot, "metadata", "08", "e0", "PubMedCentral-11000001-v2.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata json_definitions.Metadata
+	err = json.Unmarshal(metadataBytes, &metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Title != "Growth of test organisms in controlled conditions." {
+		t.Errorf("unexpected title %q", metadata.Title)
+	}
+	if len(metadata.AuthorList) != 2 || metadata.AuthorList[0].Surname != "Smith" {
+		t.Errorf("unexpected authors %+v", metadata.AuthorList)
+	}
+	// An abstract that is not structured keeps its markup too.
+	if metadata.Abstract != "Test organisms grew steadily in CO2 under every condition we tried." ||
+		metadata.AbstractMarkup != "Test organisms grew steadily in CO<sub>2</sub> under <i>every</i> condition we tried." ||
+		len(metadata.AbstractSections) != 0 {
+		t.Errorf("unexpected abstract %q with markup %q", metadata.Abstract, metadata.AbstractMarkup)
+	}
+	if metadata.Date.ISO != "2016-06-15" || metadata.Date.Source != "date-completed" {
+		t.Errorf("unexpected date %+v", metadata.Date)
+	}
+	identifiers := map[string]string{}
+	for _, identifier := range metadata.Identifier {
+		identifiers[identifier.Type] = identifier.ID
+	}
+	if identifiers["pmid"] != "11000001" || identifiers["pmcid"] != "PMC1000001" || identifiers["doi"] != "10.1000/jtb.2016.001" {
+		t.Errorf("unexpected identifiers %+v", metadata.Identifier)
+	}
+	if metadata.Path == nil || *metadata.Path != "08/e0" {
+		t.Errorf("unexpected path %v", metadata.Path)
+	}
+	if metadata.EntryFile != "PMC1000001/JTB-12-101.nxml" || metadata.CompressionType == nil || *metadata.CompressionType != "tgz" {
+		t.Errorf("unexpected entry file %q", metadata.EntryFile)
+	}
+	if metadata.License == nil || *metadata.License != "CC BY" {
+		t.Errorf("unexpected license %v", metadata.License)
+	}
+	if len(metadata.Subjects) != 2 || metadata.Subjects[0].Descriptor != "Bacteria" || metadata.Subjects[0].MajorTopic ||
+		len(metadata.Subjects[0].Qualifiers) != 2 || metadata.Subjects[0].Qualifiers[0].Name != "growth & development" ||
+		!metadata.Subjects[0].Qualifiers[0].MajorTopic || !metadata.Subjects[1].MajorTopic {
+		t.Errorf("unexpected subjects %+v", metadata.Subjects)
+	}
+	if len(metadata.Keywords) != 2 || metadata.Keywords[1] != "Testus organismus" {
+		t.Errorf("unexpected keywords %q", metadata.Keywords)
+	}
+	if len(metadata.Chemicals) != 2 || metadata.Chemicals[0].RegistryNumber != "" ||
+		metadata.Chemicals[1].Name != "Glucose" || metadata.Chemicals[1].RegistryNumber != "IY9XDZ35W2" {
+		t.Errorf("unexpected chemicals %+v", metadata.Chemicals)
+	}
+	if len(metadata.PublicationTypes) != 2 || metadata.PublicationTypes[0].Name != "Journal Article" || metadata.PublicationTypes[0].UI != "D016428" {
+		t.Errorf("unexpected publication types %+v", metadata.PublicationTypes)
+	}
+	if metadata.Journal == nil || metadata.Journal.NlmUniqueID != "101000001" || metadata.Journal.Title != "Journal of test biology" ||
+		len(metadata.Journal.ISSNs) != 1 || metadata.Journal.ISSNs[0].Type != "electronic" || metadata.Journal.ISSNs[0].ISSN != "1234-5678" {
+		t.Errorf("unexpected journal %+v", metadata.Journal)
+	}
+	if metadata.Volume != "12" || metadata.Issue != "3" || metadata.Pages != "101-10" {
+		t.Errorf("unexpected volume %q, issue %q or pages %q", metadata.Volume, metadata.Issue, metadata.Pages)
+	}
+	imageInfo, err := os.Stat(path.Join("fake_ncbi", "testdata", "packages", "PMC1000001", "JTB-12-101-g001.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Files == nil || len(*metadata.Files) != 2 {
+		t.Fatalf("unexpected files %+v", metadata.Files)
+	}
+	files := *metadata.Files
+	if files[0].Name != "PMC1000001/JTB-12-101-g001.jpg" || files[0].Size != imageInfo.Size() || files[0].MIME != "image/jpeg" {
+		t.Errorf("unexpected image file %+v", files[0])
+	}
+	if files[1].Name != "PMC1000001/JTB-12-101.nxml" || files[1].Size == 0 || files[1].MIME != "application/xml" {
+		t.Errorf("unexpected NXML file %+v", files[1])
+	}
+
+	// PubMed has no record of PMC1000003, so its metadata comes from its NXML.
+	metadataBytes, err = ioutil.ReadFile(path.Join(dataRoot, "metadata", "c3", "d4", "PubMedCentral-PMC1000003-v2.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nxmlMetadata json_definitions.Metadata
+	err = json.Unmarshal(metadataBytes, &nxmlMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nxmlMetadata.Title != "A short note on Testus organismus" {
+		t.Errorf("unexpected NXML title %q", nxmlMetadata.Title)
+	}
+	if nxmlMetadata.Abstract != "We describe Testus organismus briefly." {
+		t.Errorf("unexpected NXML abstract %q", nxmlMetadata.Abstract)
+	}
+	if len(nxmlMetadata.Keywords) != 2 || nxmlMetadata.Keywords[0] != "Testus organismus" || nxmlMetadata.Keywords[1] != "short note" {
+		t.Errorf("unexpected NXML keywords %q", nxmlMetadata.Keywords)
+	}
+	if len(nxmlMetadata.AuthorList) != 2 || nxmlMetadata.AuthorList[0].Surname != "Poe" ||
+		nxmlMetadata.AuthorList[1].Collab != "The Testus Consortium" || nxmlMetadata.AuthorList[1].Surname != "" {
+		t.Errorf("unexpected NXML authors %+v", nxmlMetadata.AuthorList)
+	}
+	// The NXML says CC BY but the license from the OA service wins.
+	if nxmlMetadata.License == nil || *nxmlMetadata.License != "CC0" {
+		t.Errorf("unexpected NXML license %v", nxmlMetadata.License)
+	}
+	if nxmlMetadata.Date.Year != "2017" || nxmlMetadata.Date.Month != "01" || nxmlMetadata.Date.Day != "01" {
+		t.Errorf("unexpected NXML date %+v", nxmlMetadata.Date)
+	}
+	if nxmlMetadata.Date.ISO != "2017-01-01" || nxmlMetadata.Date.Source != "nxml:epub" {
+		t.Errorf("unexpected NXML date source %+v", nxmlMetadata.Date)
+	}
+	if nxmlMetadata.Journal == nil || nxmlMetadata.Journal.MedlineTA != "J Test Biol" || nxmlMetadata.Journal.NlmUniqueID != "" ||
+		len(nxmlMetadata.Journal.ISSNs) != 1 || nxmlMetadata.Journal.ISSNs[0].Type != "electronic" {
+		t.Errorf("unexpected NXML journal %+v", nxmlMetadata.Journal)
+	}
+	if nxmlMetadata.Volume != "13" || nxmlMetadata.Pages != "1-9" {
+		t.Errorf("unexpected NXML volume %q or pages %q", nxmlMetadata.Volume, nxmlMetadata.Pages)
+	}
+
+	// Only the journals PubMed gave an NLM unique ID are in the registry.
+	registryBytes, err := ioutil.ReadFile(path.Join(dataRoot, "metadata", "journals.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var journals map[string]json_definitions.Journal
+	err = json.Unmarshal(registryBytes, &journals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journals) != 2 || journals["101000001"].MedlineTA != "J Test Biol" || journals["101000002"].Country != "United States" {
+		t.Errorf("unexpected journal registry %+v", journals)
+	}
+
+	// The watermark is committed and the run is no longer resumable.
+	savedConfig, err := readJSON(path.Join(dataRoot, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if savedConfig.LastDate == "" || savedConfig.LastDate != savedConfig.RunStarted {
+		t.Errorf("expected last_date to be the run start, got %+v", savedConfig)
+	}
+	// The run start is in NCBI time and held back by the overlap.
+	runStarted, err := time.ParseInLocation("20060102150405", savedConfig.RunStarted, ncbiLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedStart := time.Now().Add(-watermarkOverlap)
+	if runStarted.After(expectedStart) || runStarted.Before(expectedStart.Add(-time.Minute)) {
+		t.Errorf("expected the run start to be about %s, got %s", expectedStart, runStarted)
+	}
+	if savedConfig.ArticlesProcessed != 3 || savedConfig.BadArticles != 0 || savedConfig.PagesProcessed != 2 {
+		t.Errorf("unexpected run counts %+v", savedConfig)
+	}
+	_, err = os.Stat(path.Join(dataRoot, "oa_files", "update_checkpoint.json"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the update checkpoint to be removed, got %v", err)
+	}
+}
+
+// A sync that was interrupted picks each article up from the step the journal
+// says it reached. Articles that were ID converted are not sent to the ID
+// converter again, and a package that was downloaded is not downloaded again.
+func TestSyncResumesFromJournal(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	corpusLayout := newLayout(dataRoot, layoutConfig{})
+	target, err := openCorpus(corpusLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The DOI of PMC1000001 differs from what the ID converter would say, to
+	// show that the one in the journal is used.
+	identified := []struct {
+		pmcid   string
+		updated string
+		pmid    string
+		doi     string
+	}{
+		{"PMC1000001", "2017-01-02 10:00:00", "11000001", "10.1000/from-the-journal"},
+		{"PMC1000002", "2017-01-03 11:30:00", "11000002", "10.1000/tmj.2016.012"},
+		{"PMC1000003", "2017-01-04 09:15:00", "", "10.1000/jtb.2017.003"},
+	}
+	for _, article := range identified {
+		err = target.Journal.RecordIdentifiers(article.pmcid, article.updated, article.pmid, article.doi)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// PMC1000002 was downloaded before the run stopped.
+	resp, err := http.Get(server.URL + "/pub/pmc/oa_package/1a/2b/PMC1000002.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivePath := corpusLayout.ArchivePath("1a/2b", "PMC1000002")
+	err = os.MkdirAll(path.Dir(archivePath), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(archivePath, archive, 0644)
+	}
+	if err == nil {
+		err = target.Journal.Record("PMC1000002", "2017-01-03 11:30:00", stateDownloaded, "")
+	}
+	target.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runSync(newFakeClient(server), corpusLayout, &config{}, syncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests := server.Requests("/pmc/utils/idconv/v1.0/"); requests != 0 {
+		t.Errorf("expected the ID converter not to be asked again, got %d requests", requests)
+	}
+	// The one request for the package is the one made above.
+	if requests := server.Requests("/pub/pmc/oa_package/1a/2b/PMC1000002.tar.gz"); requests != 1 {
+		t.Errorf("expected the downloaded package not to be downloaded again, got %d requests", requests)
+	}
+	listing := readIndexedRows(t, corpusLayout)
+	expectedListing := map[string]bool{
+		"11000001,08/e0,20160615,PMC1000001,10.1000/from-the-journal": true,
+		"11000002,1a/2b,20161100,PMC1000002,10.1000/tmj.2016.012":     true,
+		"PMC1000003,c3/d4,20170101,PMC1000003,10.1000/jtb.2017.003":   true,
+	}
+	if len(listing) != len(expectedListing) {
+		t.Fatalf("expected %d listing rows, got %q", len(expectedListing), listing)
+	}
+	for _, row := range listing {
+		if !expectedListing[row] {
+			t.Errorf("unexpected listing row %q", row)
+		}
+	}
+}
+
+// The ID converter and efetch may answer in any order, so a sync against
+// services that answer backwards must still pair each article with its own
+// identifiers and metadata.
+func TestSyncWithReorderedAnswers(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.PageSize = 3
+	server.ReverseAnswers = true
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	err = runSync(newFakeClient(server), newLayout(dataRoot, layoutConfig{}), &config{}, syncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listing := readIndexedRows(t, newLayout(dataRoot, layoutConfig{}))
+	expectedListing := map[string]bool{
+		"11000001,08/e0,20160615,PMC1000001,10.1000/jtb.2016.001":   true,
+		"11000002,1a/2b,20161100,PMC1000002,10.1000/tmj.2016.012":   true,
+		"PMC1000003,c3/d4,20170101,PMC1000003,10.1000/jtb.2017.003": true,
+	}
+	if len(listing) != len(expectedListing) {
+		t.Fatalf("expected %d listing rows, got %q", len(expectedListing), listing)
+	}
+	for _, row := range listing {
+		if !expectedListing[row] {
+			t.Errorf("unexpected listing row %q", row)
+		}
+	}
+
+	expectedTitles := map[string]string{
+		path.Join("08", "e0", "PubMedCentral-11000001-v2.json"): "Growth of test organisms in controlled conditions.",
+		path.Join("1a", "2b", "PubMedCentral-11000002-v2.json"): "A trial of placebo against placebo.",
+	}
+	for metadataFile, expectedTitle := range expectedTitles {
+		metadataBytes, err := ioutil.ReadFile(path.Join(dataRoot, "metadata", metadataFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var metadata json_definitions.Metadata
+		err = json.Unmarshal(metadataBytes, &metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.Title != expectedTitle {
+			t.Errorf("%s has title %q, expected %q", metadataFile, metadata.Title, expectedTitle)
+		}
+	}
+}
+
+func TestSyncPDFOnly(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	// Only PMC1000002 is offered as a PDF.
+	corpusLayout := newLayout(dataRoot, layoutConfig{})
+	runConfig := &config{Formats: "pdf"}
+	err = runSync(newFakeClient(server), corpusLayout, runConfig, syncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listing := readIndexedRows(t, corpusLayout)
+	if len(listing) != 1 || listing[0] != "11000002,1a/2b,20161100,PMC1000002,10.1000/tmj.2016.012" {
+		t.Errorf("unexpected listing %q", listing)
+	}
+	if requests := server.Requests("/pub/pmc/oa_package/1a/2b/PMC1000002.tar.gz"); requests != 0 {
+		t.Errorf("expected the package not to be downloaded")
+	}
+	_, err = os.Stat(path.Join(corpusLayout.ArticlePath("1a/2b", "PMC1000002"), "PMC1000002.pdf"))
+	if err != nil {
+		t.Errorf("PDF was not stored: %v", err)
+	}
+
+	metadataBytes, err := ioutil.ReadFile(corpusLayout.MetadataFilePath("1a/2b", "11000002"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata json_definitions.Metadata
+	err = json.Unmarshal(metadataBytes, &metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.EntryFile != "PMC1000002/PMC1000002.pdf" || metadata.CompressionType == nil || *metadata.CompressionType != "none" {
+		t.Errorf("unexpected entry file %q", metadata.EntryFile)
+	}
+	// The publisher supplied the citation of PMC1000002, so it has not been
+	// completed and the date comes from the issue it is in.
+	if metadata.Date.ISO != "2016-11" || metadata.Date.Source != "medline-date" || metadata.Date.Month != "11" || metadata.Date.Day != "" {
+		t.Errorf("unexpected date %+v", metadata.Date)
+	}
+
+	// PMC1000002 has a structured abstract with markup in it.
+	expectedAbstract := "BACKGROUND: Placebo is rarely compared with itself. " +
+		"PATIENTS AND METHODS: Two arms of 102 patients each received placebo. " +
+		"RESULTS: Neither arm of the trial outperformed the other."
+	if metadata.Abstract != expectedAbstract {
+		t.Errorf("unexpected abstract %q", metadata.Abstract)
+	}
+	if len(metadata.AbstractSections) != 3 {
+		t.Fatalf("unexpected abstract sections %+v", metadata.AbstractSections)
+	}
+	methods := metadata.AbstractSections[1]
+	if methods.Label != "PATIENTS AND METHODS" || methods.Category != "METHODS" || methods.Text != "Two arms of 102 patients each received placebo." {
+		t.Errorf("unexpected methods section %+v", methods)
+	}
+	// The markup is kept next to the plain text, where there is any.
+	if methods.Markup != "Two arms of 10<sup>2</sup> patients each received placebo." {
+		t.Errorf("unexpected methods markup %q", methods.Markup)
+	}
+	if results := metadata.AbstractSections[2]; results.Markup != "" {
+		t.Errorf("expected no markup for a section without any, got %q", results.Markup)
+	}
+	expectedMarkup := "BACKGROUND: Placebo is rarely compared with <i>itself</i>. " +
+		"PATIENTS AND METHODS: Two arms of 10<sup>2</sup> patients each received placebo. " +
+		"RESULTS: Neither arm of the trial outperformed the other."
+	if metadata.AbstractMarkup != expectedMarkup {
+		t.Errorf("unexpected abstract markup %q", metadata.AbstractMarkup)
+	}
+}
+
+// Plenty of articles have no DOI, and the ID converter leaves the attribute
+// out for them. Such an article is still saved with an empty DOI, unless a
+// DOI is required, in which case it goes to the bad listing.
+func TestSyncWithoutDOI(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata", "no_doi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	corpusLayout := newLayout(dataRoot, layoutConfig{})
+	err = runSync(newFakeClient(server), corpusLayout, &config{}, syncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listing := readIndexedRows(t, corpusLayout)
+	if len(listing) != 1 || listing[0] != "11000004,4e/5f,20161205,PMC1000004," {
+		t.Errorf("unexpected listing %q", listing)
+	}
+	entries := 0
+	err = readIndex(corpusLayout, func(entry indexEntry) {
+		entries++
+		if entry.PMCID != "PMC1000004" || entry.DOI != "" {
+			t.Errorf("unexpected index entry %+v", entry)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries != 1 {
+		t.Errorf("expected 1 index entry, got %d", entries)
+	}
+	_, err = os.Stat(path.Join(dataRoot, "metadata", "4e", "5f", "PubMedCentral-11000004-v2.json"))
+	if err != nil {
+		t.Errorf("expected the metadata to be saved: %v", err)
+	}
+
+	requiredRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(requiredRoot)
+
+	requiredLayout := newLayout(requiredRoot, layoutConfig{})
+	runConfig := &config{RequiredIdentifiers: []string{"doi"}}
+	err = runSync(newFakeClient(server), requiredLayout, runConfig, syncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listing := readIndexedRows(t, requiredLayout); len(listing) != 0 {
+		t.Errorf("expected nothing to be indexed, got %q", listing)
+	}
+	badListing := readLines(t, requiredLayout.BadArticleListingPath())
+	if len(badListing) != 1 || !strings.HasPrefix(badListing[0], "PMC1000004,DOIError,1,") {
+		t.Errorf("unexpected bad listing %q", badListing)
+	}
+}
+
+func TestBaselineAgainstFakeServer(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	// PMC1000001 is already in the corpus so only PMC1000002 should be
+	// downloaded. PMC1000003 has no PMID, which is required here, so it ends
+	// up in the bad listing.
+	corpusLayout := newLayout(dataRoot, layoutConfig{})
+	err = os.MkdirAll(corpusLayout.OAFilesPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existingRow := "11000001,08/e0,20160615,PMC1000001,10.1000/jtb.2016.001\n"
+	err = ioutil.WriteFile(corpusLayout.ArticleListingPath(), []byte(existingRow), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := openCorpus(corpusLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runConfig := &config{RequiredIdentifiers: []string{"pmid"}}
+	err = newFakeClient(server).runBaseline(target, runConfig, "", syncOptions{})
+	target.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests := server.Requests("/pmc/utils/oa/oa.fcgi"); requests != 0 {
+		t.Errorf("expected the OA service not to be used, got %d requests", requests)
+	}
+	if requests := server.Requests("/pub/pmc/oa_package/08/e0/PMC1000001.tar.gz"); requests != 0 {
+		t.Errorf("expected the listed article not to be downloaded again")
+	}
+
+	listing := readIndexedRows(t, corpusLayout)
+	if len(listing) != 2 || listing[1] != "11000002,1a/2b,20161100,PMC1000002,10.1000/tmj.2016.012" {
+		t.Errorf("unexpected listing %q", listing)
+	}
+	// The update time and license come from the file list.
+	err = readIndex(corpusLayout, func(entry indexEntry) {
+		if entry.PMCID == "PMC1000002" && (entry.Updated != "2017-01-03 11:30:00" || entry.License != "CC BY-NC") {
+			t.Errorf("unexpected index entry %+v", entry)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	badListing := readLines(t, corpusLayout.BadArticleListingPath())
+	if len(badListing) != 1 || !strings.HasPrefix(badListing[0], "PMC1000003,PMIDError,1,") {
+		t.Errorf("unexpected bad listing %q", badListing)
+	}
+
+	// The next sync starts from the newest article in the file list.
+	if runConfig.LastDate != "20170104091500" {
+		t.Errorf("expected the watermark to move to the newest update, got %q", runConfig.LastDate)
+	}
+}
+
+// The sync after a baseline asks for everything from the newest article in
+// the file list on, as the file list and the watermark are in the same time
+// zone.
+func TestSyncAfterBaseline(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	corpusLayout := newLayout(dataRoot, layoutConfig{})
+	target, err := openCorpus(corpusLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runConfig := &config{}
+	err = newFakeClient(server).runBaseline(target, runConfig, "", syncOptions{})
+	target.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runSync(newFakeClient(server), corpusLayout, runConfig, syncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The newest article in the file list was updated at 2017-01-04 09:15:00.
+	froms := server.UpdateFroms()
+	if len(froms) != 1 || froms[0] == "" || froms[0] > "2017-01-04 09:15:00" {
+		t.Errorf("expected the sync to start no later than the newest article, got %q", froms)
+	}
+	if requests := server.Requests("/pub/pmc/oa_package/c3/d4/PMC1000003.tar.gz"); requests != 1 {
+		t.Errorf("expected the article listed again by the sync not to be downloaded again, got %d requests", requests)
+	}
+}
+
+// The OA file list only has tgz packages, so a PDF only baseline looks each
+// article up to find its PDF. Articles without one are skipped, and the
+// watermark is kept below them so a later sync lists them again.
+func TestBaselinePDFOnly(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	corpusLayout := newLayout(dataRoot, layoutConfig{})
+	target, err := openCorpus(corpusLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runConfig := &config{Formats: "pdf"}
+	err = newFakeClient(server).runBaseline(target, runConfig, "", syncOptions{})
+	target.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests := server.Requests("/pmc/utils/oa/oa.fcgi"); requests != 3 {
+		t.Errorf("expected every article to be looked up, got %d requests", requests)
+	}
+	listing := readIndexedRows(t, corpusLayout)
+	if len(listing) != 1 || !strings.HasPrefix(listing[0], "11000002,1a/2b,") {
+		t.Errorf("unexpected listing %q", listing)
+	}
+	_, err = os.Stat(path.Join(corpusLayout.ArticlePath("1a/2b", "PMC1000002"), "PMC1000002.pdf"))
+	if err != nil {
+		t.Errorf("PDF was not stored: %v", err)
+	}
+	if badListing := readLines(t, corpusLayout.BadArticleListingPath()); len(badListing) != 0 {
+		t.Errorf("unexpected bad listing %q", badListing)
+	}
+
+	// PMC1000001 was updated at 2017-01-02 10:00:00 and is the oldest of the
+	// skipped articles.
+	if runConfig.LastDate != "20170102095959" {
+		t.Errorf("expected the watermark to stop short of the skipped articles, got %q", runConfig.LastDate)
+	}
+}
+
+// Articles in the bad listing are retried once they are due. Those that now
+// resolve are saved and dropped from the listing, and the rest have their
+// attempt counted.
+func TestRetryBadArticles(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	corpusLayout := newLayout(dataRoot, layoutConfig{})
+	err = os.MkdirAll(corpusLayout.OAFilesPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recently := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	// PMC1000003 has no PMID but is no longer required to, PMC1000009 is not
+	// in the OA subset, and PMC1000002 failed too recently to be due. The
+	// first row of PMC1000003 is in the format used before attempts were
+	// counted.
+	badListing := "PMC1000003,PMIDError\n" +
+		"PMC1000009,IDConvMissing,1,2017-01-01T00:00:00Z,2017-01-01T00:00:00Z\n" +
+		"PMC1000002,DownloadError,2,2017-01-01T00:00:00Z," + recently + "\n" +
+		"PMC1000003,PMIDError,1,2017-01-02T00:00:00Z,2017-01-02T00:00:00Z\n"
+	err = ioutil.WriteFile(corpusLayout.BadArticleListingPath(), []byte(badListing), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := openCorpus(corpusLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newFakeClient(server).retryBadArticles(target, &config{}, retryOptions{Interval: 24 * time.Hour, Concurrency: 2})
+	target.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listing := readIndexedRows(t, corpusLayout)
+	if len(listing) != 1 || listing[0] != "PMC1000003,c3/d4,20170101,PMC1000003,10.1000/jtb.2017.003" {
+		t.Errorf("unexpected listing %q", listing)
+	}
+	entries, err := readBadListing(corpusLayout.BadArticleListingPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected bad listing %+v", entries)
+	}
+	if entries[0].PMCID != "PMC1000009" || entries[0].Reason != "NotInOA" || entries[0].Attempts != 2 ||
+		entries[0].FirstSeen != "2017-01-01T00:00:00Z" || entries[0].LastAttempt <= "2017-01-01T00:00:00Z" {
+		t.Errorf("unexpected retried entry %+v", entries[0])
+	}
+	if entries[1].PMCID != "PMC1000002" || entries[1].Attempts != 2 || entries[1].LastAttempt != recently {
+		t.Errorf("expected the entry that is not due to be left alone, got %+v", entries[1])
+	}
+	if requests := server.Requests("/pub/pmc/oa_package/1a/2b/PMC1000002.tar.gz"); requests != 0 {
+		t.Errorf("expected the article that is not due not to be downloaded")
+	}
+}
+
+// Fetching an article that failed before tries it again rather than skipping
+// it as finished.
+func TestFetchFailedArticle(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	corpusLayout := newLayout(dataRoot, layoutConfig{})
+	target, err := openCorpus(corpusLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	failedRecord := record{ID: "PMC1000001"}
+	failedRecord.Link.Updated = "2017-01-02 10:00:00"
+	err = markArticleFailed(target.Journal, target.BadArticleListing, failedRecord, "DownloadError")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = newFakeClient(server).fetchArticles(target, &config{}, []string{"PMC1000001"}, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests := server.Requests("/pub/pmc/oa_package/08/e0/PMC1000001.tar.gz"); requests != 1 {
+		t.Errorf("expected the failed article to be downloaded again, got %d requests", requests)
+	}
+	entry, found, err := target.Index.ByPMCID("PMC1000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || entry.Updated != "2017-01-02 10:00:00" {
+		t.Errorf("expected the failed article to be indexed, got %+v", entry)
+	}
+	if state := target.Journal.State("PMC1000001", "2017-01-02 10:00:00"); state != stateIndexed {
+		t.Errorf("expected the journal to have the article indexed, got %q", state)
+	}
+}
+
+// Importing the old listing keeps one entry per article, the latest, and
+// copes with DOIs that have commas in them. Exporting quotes those DOIs so
+// the listing can be read back.
+func TestIndexImportExport(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	listingPath := path.Join(dataRoot, "article_listing.csv")
+	oldListing := "PMC1000003,c3/d4,20170101,PMC1000003,10.1000/jtb.2017.003\n" +
+		"11000001,08/e0,20160615,PMC1000001,10.1000/jtb(2016),001\n" +
+		"11000001,08/e0,20160616,PMC1000001,10.1000/jtb(2016),001\n" +
+		"11000003,c3/d4,20170101,PMC1000003,10.1000/jtb.2017.003\n" +
+		"11000001,aa/bb,20170101,PMC1000099,10.1000/other\n"
+	err = ioutil.WriteFile(listingPath, []byte(oldListing), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := openIndex(path.Join(dataRoot, "article_index.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	imported, err := index.importListing(listingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last row gives PMC1000099 the PMID of PMC1000001, so it is skipped.
+	if imported != 4 {
+		t.Errorf("expected 4 rows to be imported, got %d", imported)
+	}
+	count, err := index.Count()
+	if err != nil || count != 2 {
+		t.Errorf("expected 2 articles in the index, got %d (%v)", count, err)
+	}
+
+	entry, found, err := index.ByDOI("10.1000/JTB(2016),001")
+	if err != nil || !found || entry.PMID != "11000001" || entry.Date != "20160616" {
+		t.Errorf("unexpected DOI lookup %+v %v %v", entry, found, err)
+	}
+	// PMC1000003 was given a PMID, so it has moved from its PMCID to it.
+	_, found, err = index.Get("PMC1000003")
+	if err != nil || found {
+		t.Errorf("expected the PMCID entry to be replaced, got %v %v", found, err)
+	}
+	entry, found, err = index.ByPMCID("PMC1000003")
+	if err != nil || !found || entry.Key() != "11000003" {
+		t.Errorf("unexpected PMCID lookup %+v %v %v", entry, found, err)
+	}
+
+	// PubMed linking another PMCID to the PMID of PMC1000001 does not take
+	// its entry away.
+	_, err = index.Put(indexEntry{PMID: "11000001", PMCID: "PMC1000099", Path: "aa/bb", Date: "20170101", DOI: "10.1000/other"})
+	var conflict *indexConflictError
+	if !errors.As(err, &conflict) || conflict.ExistingPMCID != "PMC1000001" {
+		t.Errorf("expected a conflict with PMC1000001, got %v", err)
+	}
+	entry, found, err = index.ByPMCID("PMC1000001")
+	if err != nil || !found || entry.DOI != "10.1000/jtb(2016),001" {
+		t.Errorf("expected PMC1000001 to be untouched, got %+v %v %v", entry, found, err)
+	}
+	_, found, err = index.ByPMCID("PMC1000099")
+	if err != nil || found {
+		t.Errorf("expected PMC1000099 not to be indexed, got %v %v", found, err)
+	}
+
+	var exported strings.Builder
+	err = index.exportListing(&exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "11000001,08/e0,20160616,PMC1000001,\"10.1000/jtb(2016),001\"\n" +
+		"11000003,c3/d4,20170101,PMC1000003,10.1000/jtb.2017.003\n"
+	if exported.String() != expected {
+		t.Errorf("unexpected export %q", exported.String())
+	}
+}
+
+// A sync that finds a new version of an article replaces the stored one and
+// updates its index entry in place instead of adding another.
+func TestSyncReplacesUpdatedArticles(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	corpusLayout := newLayout(dataRoot, layoutConfig{})
+	client := newFakeClient(server)
+	runConfig := &config{}
+	err = runSync(client, corpusLayout, runConfig, syncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !server.UpdateRecord("PMC1000001", "2018-02-01 08:00:00") {
+		t.Fatal("PMC1000001 is not in the fixtures")
+	}
+	runConfig.LastDate = "20180101000000"
+	err = runSync(client, corpusLayout, runConfig, syncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests := server.Requests("/pub/pmc/oa_package/08/e0/PMC1000001.tar.gz"); requests != 2 {
+		t.Errorf("expected the updated package to be downloaded again, got %d requests", requests)
+	}
+
+	rows := readIndexedRows(t, corpusLayout)
+	if len(rows) != 3 {
+		t.Errorf("expected the index to still hold 3 articles, got %q", rows)
+	}
+	index, err := openIndex(corpusLayout.IndexPath(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	entry, found, err := index.ByPMCID("PMC1000001")
+	if err != nil || !found {
+		t.Fatalf("PMC1000001 is missing from the index: %v", err)
+	}
+	if entry.Revision != 2 || entry.Updated != "2018-02-01 08:00:00" || entry.PreviousUpdated != "2017-01-02 10:00:00" || entry.License != "CC BY" {
+		t.Errorf("unexpected index entry %+v", entry)
+	}
+	entry, _, err = index.ByPMCID("PMC1000002")
+	if err != nil || entry.Revision != 1 || entry.PreviousUpdated != "" {
+		t.Errorf("expected PMC1000002 to be untouched, got %+v", entry)
+	}
+
+	files, err := ioutil.ReadDir(path.Join(dataRoot, "articles", "08", "e0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "PMC1000001" {
+		t.Errorf("expected only the article folder to be left, got %v", files)
+	}
+	_, err = os.Stat(path.Join(dataRoot, "articles", "08", "e0", "PMC1000001", "JTB-12-101.nxml"))
+	if err != nil {
+		t.Errorf("the new version was not stored: %v", err)
+	}
+}
+
+// Citations that have not been completed fall back through the other dates
+// PubMed gives.
+func TestResolvePubmedDate(t *testing.T) {
+	withHistory := xml_definitions.PubmedArticle{}
+	withHistory.PubmedData.History = []xml_definitions.PubMedPubDate{
+		{PubStatus: "received", Year: "2015", Month: "11", Day: "20"},
+		{PubStatus: "pubmed", Year: "2016", Month: "3", Day: "4"},
+	}
+	withArticleDate := xml_definitions.PubmedArticle{}
+	withArticleDate.MedlineCitation.Article.ArticleDate = xml_definitions.ArticleDate{Year: "2016", Month: "02", Day: "29"}
+	withArticleDate.PubmedData.History = withHistory.PubmedData.History
+	withPubDate := xml_definitions.PubmedArticle{}
+	withPubDate.MedlineCitation.Article.Journal.JournalIssue.PubDate = xml_definitions.Date{Year: "2014", Month: "Sep"}
+	withSeason := xml_definitions.PubmedArticle{}
+	withSeason.MedlineCitation.Article.Journal.JournalIssue.PubDate = xml_definitions.Date{MedlineDate: "2000 Spring"}
+	withRange := xml_definitions.PubmedArticle{}
+	withRange.MedlineCitation.Article.Journal.JournalIssue.PubDate = xml_definitions.Date{MedlineDate: "1998 Dec 15-1999 Jan 10"}
+
+	tests := []struct {
+		name    string
+		article xml_definitions.PubmedArticle
+		iso     string
+		source  string
+		listing string
+	}{
+		{"history", withHistory, "2016-03-04", "history:pubmed", "20160304"},
+		{"article date", withArticleDate, "2016-02-29", "article-date", "20160229"},
+		{"month name", withPubDate, "2014-09", "pub-date", "20140900"},
+		{"season", withSeason, "2000", "medline-date", "20000000"},
+		{"range", withRange, "1998-12-15", "medline-date", "19981215"},
+		{"nothing", xml_definitions.PubmedArticle{}, "", "", ""},
+	}
+	for _, test := range tests {
+		date := resolvePubmedDate(&test.article)
+		if date.ISO != test.iso || date.Source != test.source {
+			t.Errorf("%s: got %+v, expected %s from %s", test.name, date, test.iso, test.source)
+		}
+		if listing := listingDate(date); listing != test.listing {
+			t.Errorf("%s: got listing date %q, expected %q", test.name, listing, test.listing)
+		}
+	}
+}
+
+func TestConvertJATSToJSONLicense(t *testing.T) {
+	tests := []struct {
+		name     string
+		licenses string
+		license  string
+	}{
+		{"href", `<license license-type="open-access" xlink:href="https://creativecommons.org/licenses/by/4.0/"/>`, "https://creativecommons.org/licenses/by/4.0/"},
+		{"type only", `<license license-type="open-access"/>`, "open-access"},
+		{"first of two", `<license license-type="cc-by"/><license license-type="cc0"/>`, "cc-by"},
+		{"none", ``, ""},
+	}
+	for _, test := range tests {
+		nxml := `<article xmlns:xlink="http://www.w3.org/1999/xlink"><front><article-meta>` +
+			`<title-group><article-title>A title</article-title></title-group>` +
+			`<permissions>` + test.licenses + `</permissions>` +
+			`</article-meta></front></article>`
+		jatsArticle, err := xml_definitions.ParseJATS([]byte(nxml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata, err := convertJATSToJSON(jatsArticle, "aa/bb", nil, "PMC1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		license := ""
+		if metadata.License != nil {
+			license = *metadata.License
+		}
+		if license != test.license {
+			t.Errorf("%s: got license %q, expected %q", test.name, license, test.license)
+		}
+	}
+}
+
+func TestLinkPaths(t *testing.T) {
+	tests := []struct {
+		href     string
+		url      string
+		hashPath string
+	}{
+		{"ftp://ftp.ncbi.nlm.nih.gov/pub/pmc/oa_package/08/e0/PMC13900.tar.gz", "http://ftp.ncbi.nlm.nih.gov/pub/pmc/oa_package/08/e0/PMC13900.tar.gz", "08/e0"},
+		{"oa_package/08/e0/PMC13900.tar.gz", "", ""},
+		{"ftp.ncbi.nlm.nih.gov/pub/pmc/oa_package/08/e0/PMC13900.tar.gz", "", ""},
+		{"ftp://ftp.ncbi.nlm.nih.gov/PMC13900.tar.gz", "http://ftp.ncbi.nlm.nih.gov/PMC13900.tar.gz", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		linkURL, err := linkHTTPURL(test.href)
+		if linkURL != test.url || (err == nil) != (test.url != "") {
+			t.Errorf("linkHTTPURL(%q) = %q, %v", test.href, linkURL, err)
+		}
+		hashPath, err := linkHashPath(test.href)
+		if hashPath != test.hashPath || (err == nil) != (test.hashPath != "") {
+			t.Errorf("linkHashPath(%q) = %q, %v", test.href, hashPath, err)
+		}
+	}
+}
+
+// A record with a link that cannot be downloaded goes to the bad listing
+// rather than taking the run down.
+func TestProcessRecordsWithBadLink(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	corpusLayout := newLayout(dataRoot, layoutConfig{})
+	target, err := openCorpus(corpusLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badRecord := record{
+		ID: "PMC1000009",
+		Links: []recordLink{{
+			Format:  "tgz",
+			Updated: "2017-01-05 10:00:00",
+			Href:    "oa_package/PMC1000009.tar.gz",
+		}},
+	}
+	runConfig := &config{}
+	err = NewClient("test@example.com", "").processRecords([]record{badRecord}, target, runConfig, 1)
+	target.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runConfig.BadArticles != 1 {
+		t.Errorf("expected the article to be counted as bad, got %+v", runConfig)
+	}
+	badListing := readLines(t, corpusLayout.BadArticleListingPath())
+	if len(badListing) != 1 || !strings.HasPrefix(badListing[0], "PMC1000009,LinkError,1,") {
+		t.Errorf("unexpected bad listing %q", badListing)
+	}
+}
+
+// newLimitedFakeClient returns a Client pointed at server that is rate
+// limited like the real one, at requestsPerSecond.
+func newLimitedFakeClient(server *fake_ncbi.Server, requestsPerSecond int) *Client {
+	client := newFakeClient(server)
+	client.HTTPClient = &http.Client{
+		Transport: newLimitedTransport(newRateLimiter(requestsPerSecond), server.Client().Transport),
+	}
+	return client
+}
+
+// A request rejected with 429 is sent again once the Retry-After delay the
+// server gave has passed.
+func TestTooManyRequestsIsRetriedAfterDelay(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.TooManyRequests = 1
+	server.RetryAfter = "1"
+
+	client := newLimitedFakeClient(server, apiKeyRequestsPerSecond)
+	started := time.Now()
+	_, err = client.fetchURL(server.RecordURLBase() + "PMC1000001")
+	elapsed := time.Since(started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests := server.Requests("/pmc/utils/oa/oa.fcgi"); requests != 2 {
+		t.Errorf("expected the request to be sent twice, got %d", requests)
+	}
+	if elapsed < time.Second {
+		t.Errorf("expected the retry to wait out Retry-After, took %v", elapsed)
+	}
+}
+
+// 429 is only retried by the transport. Once it gives up the request is not
+// retried again on top of that.
+func TestTooManyRequestsIsRetriedOnce(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.TooManyRequests = 100
+	server.RetryAfter = "0"
+
+	client := newLimitedFakeClient(server, apiKeyRequestsPerSecond)
+	client.RetryPolicy = retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	_, err = client.fetchURL(server.RecordURLBase() + "PMC1000001")
+	var status *statusError
+	if !errors.As(err, &status) || status.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a 429 status error, got %v", err)
+	}
+	if isRetryable(err) {
+		t.Errorf("expected a 429 the transport gave up on not to be retried")
+	}
+	if requests := server.Requests("/pmc/utils/oa/oa.fcgi"); requests != maxTooManyRequestsRetries+1 {
+		t.Errorf("expected %d requests, got %d", maxTooManyRequestsRetries+1, requests)
+	}
+}
+
+// N requests through the rate limiter take at least (N-1)/rate seconds, both
+// with and without an API key.
+func TestRequestsArePaced(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for _, rate := range []int{defaultRequestsPerSecond, apiKeyRequestsPerSecond} {
+		client := newLimitedFakeClient(server, rate)
+		requests := rate + 1
+		started := time.Now()
+		for request := 0; request < requests; request++ {
+			_, err = client.fetchURL(server.RecordURLBase() + "PMC1000001")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		elapsed := time.Since(started)
+		expected := time.Duration(requests-1) * time.Second / time.Duration(rate)
+		// Allow a millisecond for rounding in the token arithmetic.
+		if elapsed < expected-time.Millisecond {
+			t.Errorf("%d requests at %d per second took %v, expected at least %v", requests, rate, elapsed, expected)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2017, time.January, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", defaultRetryAfter},
+		{"0", 0},
+		{"5", 5 * time.Second},
+		{"-1", defaultRetryAfter},
+		{"soon", defaultRetryAfter},
+		{"Mon, 02 Jan 2017 10:00:30 GMT", 30 * time.Second},
+		{"Monday, 02-Jan-17 10:01:00 GMT", time.Minute},
+		{"Mon, 02 Jan 2017 09:59:00 GMT", 0},
+	}
+	for _, test := range tests {
+		delay := parseRetryAfter(test.value, now)
+		if delay != test.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, expected %v", test.value, delay, test.expected)
+		}
+	}
+}
+
+// A sync window without any changes still completes, moving the watermark
+// forward and dropping the checkpoint of an earlier attempt.
+func TestSyncWithNoChanges(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	corpusLayout := newLayout(dataRoot, layoutConfig{})
+	err = os.MkdirAll(corpusLayout.OAFilesPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saveCheckpoint(&updateCheckpoint{From: "2016-01-01+00:00:00", PageURL: server.UpdateURLBase() + "2016-01-01", PageNumber: 2}, corpusLayout.UpdateCheckpointPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runConfig := &config{LastDate: "20180101000000"}
+	err = runSync(newFakeClient(server), corpusLayout, runConfig, syncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runConfig.LastDate == "20180101000000" || runConfig.LastDate != runConfig.RunStarted {
+		t.Errorf("expected the watermark to move to the run start, got %+v", runConfig)
+	}
+	_, err = os.Stat(corpusLayout.UpdateCheckpointPath())
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the checkpoint to be removed, got %v", err)
+	}
+}
+
+// A page that is not the XML of the OA service is a permanent error rather
+// than an empty page.
+func TestSyncWithUnreadablePage(t *testing.T) {
+	server, err := fake_ncbi.NewServer(path.Join("fake_ncbi", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataRoot, err := ioutil.TempDir("", "PMCData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	client := newFakeClient(server)
+	client.UpdateURLBase = server.FileListURL() + "?from="
+	runConfig := &config{LastDate: "20170101000000"}
+	err = runSync(client, newLayout(dataRoot, layoutConfig{}), runConfig, syncOptions{})
+	if err == nil || isRetryable(err) {
+		t.Errorf("expected a permanent error, got %v", err)
+	}
+	if runConfig.LastDate != "20170101000000" {
+		t.Errorf("expected the watermark to be left alone, got %q", runConfig.LastDate)
+	}
+}
+
+// Flags may come after the arguments of a subcommand, and each subcommand only
+// accepts the flags it honours.
+func TestParseCommandArgs(t *testing.T) {
+	tests := []struct {
+		name         string
+		newCommand   func(common *commonFlags) *command
+		args         []string
+		expectedArgs []string
+		expected     commonFlags
+		expectError  bool
+	}{
+		{"flags after arguments", newFetchCommand, []string{"PMC123", "--dry-run", "PMC456", "--concurrency", "2"},
+			[]string{"PMC123", "PMC456"}, commonFlags{Concurrency: 2, DryRun: true}, false},
+		{"flags before arguments", newFetchCommand, []string{"--dry-run", "PMC123"},
+			[]string{"PMC123"}, commonFlags{DryRun: true}, false},
+		{"data root after the path", newIndexCommand, []string{"import", "x.csv", "--data-root", "y"},
+			[]string{"import", "x.csv"}, commonFlags{DataRoot: "y"}, false},
+		{"stdout export", newIndexCommand, []string{"export", "-", "--config", "c.json"},
+			[]string{"export", "-"}, commonFlags{ConfigPath: "c.json"}, false},
+		{"arguments after --", newFetchCommand, []string{"PMC123", "--", "--dry-run"},
+			[]string{"PMC123", "--dry-run"}, commonFlags{}, false},
+		{"no arguments", newSyncCommand, []string{"--concurrency=3"},
+			[]string{}, commonFlags{Concurrency: 3}, false},
+		{"verify has no concurrency", newVerifyCommand, []string{"--concurrency", "2"}, nil, commonFlags{}, true},
+		{"stats has no dry run", newStatsCommand, []string{"--dry-run"}, nil, commonFlags{}, true},
+		{"index has no concurrency", newIndexCommand, []string{"export", "--concurrency", "2"}, nil, commonFlags{}, true},
+		{"config has no concurrency", newConfigCommand, []string{"--concurrency", "2"}, nil, commonFlags{}, true},
+	}
+	for _, test := range tests {
+		common := &commonFlags{}
+		selected := test.newCommand(common)
+		selected.flags.SetOutput(ioutil.Discard)
+		selected.flags.Usage = func() {}
+		args, err := parseCommandArgs(selected.flags, test.args)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", test.name, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if strings.Join(args, " ") != strings.Join(test.expectedArgs, " ") || len(args) != len(test.expectedArgs) {
+			t.Errorf("%s: expected arguments %q, got %q", test.name, test.expectedArgs, args)
+		}
+		if *common != test.expected {
+			t.Errorf("%s: expected flags %+v, got %+v", test.name, test.expected, *common)
+		}
+	}
+}
+
+// NCBI_API_KEY wins over api_key in config.json.
+func TestResolveAPIKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		envKey    string
+		configKey string
+		expected  string
+	}{
+		{"neither", "", "", ""},
+		{"config only", "", "config-key", "config-key"},
+		{"environment only", "env-key", "", "env-key"},
+		{"environment over config", "env-key", "config-key", "env-key"},
+	}
+	for _, test := range tests {
+		t.Setenv(apiKeyEnvVar, test.envKey)
+		apiKey := resolveAPIKey(&config{APIKey: test.configKey})
+		if apiKey != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, apiKey)
+		}
+	}
+}
+
+func TestRedactAPIKey(t *testing.T) {
+	urlTests := []struct {
+		rawURL   string
+		expected string
+	}{
+		{"https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?id=1&api_key=secret",
+			"https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?id=1&api_key=REDACTED"},
+		{"https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?api_key=secret&id=1",
+			"https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?api_key=REDACTED&id=1"},
+		{"https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?id=1",
+			"https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?id=1"},
+		{"https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?id=1&api_key=",
+			"https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?id=1&api_key=REDACTED"},
+	}
+	for _, test := range urlTests {
+		redacted := redactURL(test.rawURL)
+		if redacted != test.expected {
+			t.Errorf("redactURL(%q) = %q, expected %q", test.rawURL, redacted, test.expected)
+		}
+	}
+
+	keyedURL := "https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?id=1&api_key=secret"
+	urlErr := &url.Error{Op: "Get", URL: keyedURL, Err: io.ErrUnexpectedEOF}
+	plainErr := errors.New("connection reset")
+	errorTests := []struct {
+		name string
+		err  error
+	}{
+		{"url error", urlErr},
+		{"wrapped url error", fmt.Errorf("downloading metadata: %w", urlErr)},
+		{"other error", plainErr},
+	}
+	for _, test := range errorTests {
+		redacted := redactError(test.err)
+		if strings.Contains(redacted.Error(), "secret") {
+			t.Errorf("%s: the key is still in %q", test.name, redacted.Error())
+		}
+		// What the error wraps is kept so it is still classified the same.
+		if !errors.Is(redacted, io.ErrUnexpectedEOF) && test.err != plainErr {
+			t.Errorf("%s: lost the wrapped error in %q", test.name, redacted.Error())
+		}
+		var redactedURLErr *url.Error
+		if test.err != plainErr && (!errors.As(redacted, &redactedURLErr) || redactedURLErr.URL != redactURL(keyedURL)) {
+			t.Errorf("%s: expected a redacted *url.Error in the chain of %q", test.name, redacted.Error())
+		}
+		if test.err == plainErr && redacted != plainErr {
+			t.Errorf("%s: expected the error to be returned as is, got %q", test.name, redacted.Error())
+		}
+	}
+	if isRetryable(redactError(fmt.Errorf("downloading metadata: %w", urlErr))) != isRetryable(urlErr) {
+		t.Errorf("redacting a wrapped error changed whether it is retried")
+	}
+}
+
+// The data root comes from --data-root, then $PMC_DATA_ROOT, then data_root in
+// the config file, then ./PMCData. The config file comes from --config, then
+// $PMC_CONFIG, then config.json in the data root.
+func TestResolveLayout(t *testing.T) {
+	root, err := ioutil.TempDir("", "PMCLayout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defaultRoot := defaultDataRoot()
+
+	// A relative data_root is relative to the config file.
+	settingsConfig := path.Join(root, "settings", "config.json")
+	err = os.MkdirAll(path.Dir(settingsConfig), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saveJSON(&config{DataRoot: "corpus"}, settingsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	absoluteConfig := path.Join(root, "absolute.json")
+	err = saveJSON(&config{DataRoot: path.Join(root, "absolute")}, absoluteConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missingConfig := path.Join(root, "missing.json")
+	flagRoot := path.Join(root, "flag")
+	envRoot := path.Join(root, "env")
+
+	tests := []struct {
+		name             string
+		dataRootFlag     string
+		configFlag       string
+		envDataRoot      string
+		envConfig        string
+		expectedDataRoot string
+		expectedConfig   string
+	}{
+		{"default", "", "", "", "",
+			defaultRoot, path.Join(defaultRoot, "config.json")},
+		{"environment data root", "", "", envRoot, "",
+			envRoot, path.Join(envRoot, "config.json")},
+		{"flag data root over environment", flagRoot, "", envRoot, "",
+			flagRoot, path.Join(flagRoot, "config.json")},
+		{"config data root", "", "", "", settingsConfig,
+			path.Join(root, "settings", "corpus"), settingsConfig},
+		{"absolute config data root", "", absoluteConfig, "", "",
+			path.Join(root, "absolute"), absoluteConfig},
+		{"environment data root over config", "", "", envRoot, settingsConfig,
+			envRoot, settingsConfig},
+		{"flag data root over everything", flagRoot, "", envRoot, settingsConfig,
+			flagRoot, settingsConfig},
+		{"flag config over environment", "", missingConfig, "", settingsConfig,
+			defaultRoot, missingConfig},
+		{"flag config over environment data root", "", absoluteConfig, envRoot, settingsConfig,
+			envRoot, absoluteConfig},
+	}
+	for _, test := range tests {
+		t.Setenv(dataRootEnvVar, test.envDataRoot)
+		t.Setenv(configEnvVar, test.envConfig)
+		_, corpusLayout, err := resolveLayout(test.dataRootFlag, test.configFlag)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if corpusLayout.DataRoot != test.expectedDataRoot || corpusLayout.ConfigPath != test.expectedConfig {
+			t.Errorf("%s: expected %s and %s, got %s and %s", test.name,
+				test.expectedDataRoot, test.expectedConfig, corpusLayout.DataRoot, corpusLayout.ConfigPath)
+		}
+	}
+}
+
+// data_root is only saved to a config file that was named, since one in the
+// data root would never be found again once the data root moved.
+func TestConfigDataRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "PMCConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	t.Setenv(dataRootEnvVar, "")
+	t.Setenv(configEnvVar, "")
+
+	dataRoot := path.Join(root, "PMCData")
+	status := runCommand([]string{"config", "data_root", path.Join(root, "elsewhere"), "--data-root", dataRoot})
+	if status != 2 {
+		t.Errorf("expected data_root to be refused without a named config file, got status %d", status)
+	}
+	_, err = os.Stat(path.Join(dataRoot, "config.json"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no config file to be written")
+	}
+
+	configPath := path.Join(root, "settings.json")
+	status = runCommand([]string{"config", "data_root", "corpus", "--config", configPath})
+	if status != 0 {
+		t.Fatalf("expected data_root to be saved, got status %d", status)
+	}
+	t.Setenv(configEnvVar, configPath)
+	status = runCommand([]string{"config", "email", "someone@example.com"})
+	if status != 0 {
+		t.Fatalf("expected the email to be saved, got status %d", status)
+	}
+	runConfig, corpusLayout, err := resolveLayout("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if corpusLayout.DataRoot != path.Join(root, "corpus") || runConfig.EmailAddress != "someone@example.com" {
+		t.Errorf("expected the saved data root to be used, got %s and %+v", corpusLayout.DataRoot, runConfig)
+	}
+}
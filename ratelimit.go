@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NCBI asks that clients make no more than 3 requests per second, or 10 per
+// second when the requests carry an API key. See:
+// https://www.ncbi.nlm.nih.gov/books/NBK25497/
+const defaultRequestsPerSecond = 3
+const apiKeyRequestsPerSecond = 10
+
+// The number of times a request that received a 429 response is retried
+// after waiting out the Retry-After delay before the response is handed back
+// to the caller.
+const maxTooManyRequestsRetries = 5
+
+// How long to back off after a 429 response that did not say how long to
+// wait.
+const defaultRetryAfter = time.Second
+
+// rateLimiter is a token bucket. Each request takes one token and tokens are
+// added back at a fixed rate. The bucket only holds a single token so requests
+// are spread out evenly instead of being sent in bursts.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	// The last time tokens were added to the bucket. This may be in the
+	// future if the limiter has been paused.
+	last time.Time
+}
+
+func newRateLimiter(requestsPerSecond int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(requestsPerSecond),
+		tokens: 1,
+		last:   time.Now(),
+	}
+}
+
+// SetRate changes the number of requests allowed per second.
+func (limiter *rateLimiter) SetRate(requestsPerSecond int) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.refill(time.Now())
+	limiter.rate = float64(requestsPerSecond)
+}
+
+// refill adds the tokens earned since the last refill. The caller must hold
+// the lock.
+func (limiter *rateLimiter) refill(now time.Time) {
+	if now.After(limiter.last) {
+		limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+		if limiter.tokens > 1 {
+			limiter.tokens = 1
+		}
+		limiter.last = now
+	}
+}
+
+// Wait blocks until the caller is allowed to make a request.
+func (limiter *rateLimiter) Wait() {
+	limiter.mu.Lock()
+	now := time.Now()
+	limiter.refill(now)
+
+	// Take a token now even if that leaves the bucket in debt. The debt is
+	// what tells later callers how long they have to queue behind this one.
+	limiter.tokens--
+	var delay time.Duration
+	if limiter.last.After(now) {
+		delay = limiter.last.Sub(now)
+	}
+	if limiter.tokens < 0 {
+		delay += time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	}
+	limiter.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// PauseUntil stops new tokens from being handed out before until. It is used
+// when the server tells us to slow down.
+func (limiter *rateLimiter) PauseUntil(until time.Time) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.refill(time.Now())
+	if until.After(limiter.last) {
+		limiter.last = until
+		if limiter.tokens > 0 {
+			limiter.tokens = 0
+		}
+	}
+}
+
+// limitedTransport is an http.RoundTripper that waits on a rateLimiter before
+// every request and retries requests that were rejected with 429 Too Many
+// Requests once the server's Retry-After delay has passed. Only requests
+// without a body are retried, which covers every request this tool makes.
+type limitedTransport struct {
+	limiter *rateLimiter
+	base    http.RoundTripper
+}
+
+func newLimitedTransport(limiter *rateLimiter, base http.RoundTripper) *limitedTransport {
+	return &limitedTransport{
+		limiter: limiter,
+		base:    base,
+	}
+}
+
+func (transport *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		transport.limiter.Wait()
+		resp, err := transport.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+		if attempt >= maxTooManyRequestsRetries || req.Body != nil {
+			return resp, nil
+		}
+
+		// Hold back every request, not just this one, until the server is
+		// ready for us again.
+		delay := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		resp.Body.Close()
+		transport.limiter.PauseUntil(time.Now().Add(delay))
+	}
+}
+
+// parseRetryAfter reads a Retry-After header, which may either be a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return defaultRetryAfter
+	}
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		if seconds < 0 {
+			return defaultRetryAfter
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	retryTime, err := http.ParseTime(value)
+	if err != nil {
+		return defaultRetryAfter
+	}
+	if retryTime.Before(now) {
+		return 0
+	}
+	return retryTime.Sub(now)
+}
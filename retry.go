@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// retryPolicy controls how often and how patiently a failed fetch is retried.
+type retryPolicy struct {
+	// The total number of attempts, including the first one.
+	MaxAttempts int
+	// The delay before the first retry. Each retry after that waits twice as
+	// long as the one before, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    time.Minute,
+}
+
+// statusError is returned when a server answers with anything other than
+// 200 OK.
+type statusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (err *statusError) Error() string {
+	return "Status error on: " + err.URL + " Code: " + strconv.Itoa(err.StatusCode)
+}
+
+// permanentError marks an error that will not go away by trying again, such
+// as a response that is not valid XML.
+type permanentError struct {
+	Err error
+}
+
+func (err *permanentError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *permanentError) Unwrap() error {
+	return err.Err
+}
+
+// isRetryable reports whether an error is likely to be transient. Timeouts,
+// dropped connections, truncated bodies and 5xx responses are worth
+// retrying. Everything else, including 404 responses and malformed XML, is
+// treated as permanent.
+// 429 responses are retried by limitedTransport alone, since it waits out
+// Retry-After for every request at once. A 429 that gets this far is one the
+// transport has already given up on, and retrying it here as well would
+// multiply its attempts by those of withRetry.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.StatusCode >= 500
+	}
+
+	var syntaxErr *xml.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return false
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	// This covers timeouts as well as refused and reset connections.
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// backoffDelay returns how long to wait before the given retry, with jitter
+// so that parallel workers do not all retry at the same moment.
+func (policy retryPolicy) backoffDelay(retry int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 1; i < retry && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	// Wait somewhere between half and all of the delay.
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// withRetry calls operation until it succeeds, fails with an error that is
+// not retryable, or runs out of attempts. The last error is returned.
+func withRetry(policy retryPolicy, description string, operation func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = operation()
+		if err == nil || !isRetryable(err) || attempt >= policy.MaxAttempts {
+			return err
+		}
+		delay := policy.backoffDelay(attempt)
+		log.Print("Attempt " + strconv.Itoa(attempt) + " of " + description + " failed, retrying in " + delay.String() + ": " + err.Error())
+		time.Sleep(delay)
+	}
+}
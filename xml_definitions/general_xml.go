@@ -1,6 +1,9 @@
 package xml_definitions
 
-import "encoding/xml"
+import (
+	"encoding/xml"
+	"strings"
+)
 
 type PubmedArticleSet struct {
 	XMLName        xml.Name         `xml:"PubmedArticleSet"`
@@ -20,10 +23,13 @@ type MedlineCitation struct {
 	DateRevised             Date                  `xml:"DateRevised"`
 	Article                 Article               `xml:"Article"`
 	MedlineJournalInfo      MedlineJournalInfo    `xml:"MedlineJournalInfo"`
-	ChemicalList            []Chemical            `xml:"ChemicalList"`
+	ChemicalList            []Chemical            `xml:"ChemicalList>Chemical"`
 	CitationSubset          string                `xml:"CitationSubset"`
-	CommentsCorrectionsList []CommentsCorrections `xml:"CommentsCorrectionsList"`
-	MeshHeadingList         []MeshHeading         `xml:"MeshHeadingList"`
+	CommentsCorrectionsList []CommentsCorrections `xml:"CommentsCorrectionsList>CommentsCorrections"`
+	MeshHeadingList         []MeshHeading         `xml:"MeshHeadingList>MeshHeading"`
+	// There is a list for each owner of keywords, such as NOTNLM for those
+	// given by the author.
+	KeywordLists []KeywordList `xml:"KeywordList"`
 }
 
 type PMID struct {
@@ -34,13 +40,16 @@ type PMID struct {
 type MedlineJournalInfo struct {
 	Country   string `xml:"Country"`
 	MedlineTA string `xml:"MedlineTA"`
-	// TODO: Otherwise possibly use this for journal identifier?
-	NumUniqueID int    `xml:"NumUniqueID"`
+	// The NLM catalogue ID of the journal. It stays the same when a journal
+	// changes its title or ISSN, so journals are told apart by it.
+	NlmUniqueID string `xml:"NlmUniqueID"`
 	ISSNLinking string `xml:"ISSNLinking"`
 }
 
 type Chemical struct {
-	RegistryNumber  int       `xml:"RegistryNumber"`
+	// A CAS registry number such as 50-99-7, an EC number, or 0 if there is
+	// none.
+	RegistryNumber  string    `xml:"RegistryNumber"`
 	NameOfSubstance Substance `xml:"NameOfSubstance"`
 }
 
@@ -61,8 +70,8 @@ type CommentPMID struct {
 }
 
 type MeshHeading struct {
-	DescriptorName DescriptorName `xml:"DescriptorName"`
-	QualifierName  QualifierName  `xml:"QualifierName"`
+	DescriptorName DescriptorName  `xml:"DescriptorName"`
+	QualifierNames []QualifierName `xml:"QualifierName"`
 }
 
 type DescriptorName struct {
@@ -77,12 +86,32 @@ type QualifierName struct {
 	Name         string `xml:",chardata"`
 }
 
+type KeywordList struct {
+	Owner    string    `xml:"Owner,attr"`
+	Keywords []Keyword `xml:"Keyword"`
+}
+
+// Keyword can hold inline markup such as <i>, so it is kept as it was.
+type Keyword struct {
+	MajorTopicYN string `xml:"MajorTopicYN,attr"`
+	InnerXML     string `xml:",innerxml"`
+}
+
+// String returns the keyword as plain text.
+func (keyword Keyword) String() string {
+	return PlainText(keyword.InnerXML)
+}
+
 type Date struct {
 	Year   string `xml:"Year"`
 	Month  string `xml:"Month"`
 	Day    string `xml:"Day"`
 	Hour   string `xml:"Hour"`
 	Minute string `xml:"Minute"`
+	// A PubDate that does not fall on a single month has a Season or is
+	// given as free text such as "1998 Dec-1999 Jan" instead.
+	Season      string `xml:"Season"`
+	MedlineDate string `xml:"MedlineDate"`
 }
 
 type ArticleDate struct {
@@ -107,11 +136,10 @@ type JournalIssue struct {
 }
 
 type Journal struct {
-	ISSN         ISSN         `xml:"ISSN"`
-	JournalIssue JournalIssue `xml:"JournalIssue"`
-	Title        string       `xml:"Title"`
-	// TODO: This should be what we use to split it up by publisher.
-	ISOAbbreviation string `xml:"ISOAbbreviation"`
+	ISSN            ISSN         `xml:"ISSN"`
+	JournalIssue    JournalIssue `xml:"JournalIssue"`
+	Title           string       `xml:"Title"`
+	ISOAbbreviation string       `xml:"ISOAbbreviation"`
 }
 
 type Pagination struct {
@@ -124,8 +152,68 @@ type ELocationID struct {
 	ID      string `xml:",chardata"`
 }
 
+// Abstract is made up of one AbstractText, or of one for each labelled
+// section of a structured abstract.
 type Abstract struct {
-	AbstractText string `xml:"AbstractText"`
+	AbstractTexts        []AbstractText `xml:"AbstractText"`
+	CopyrightInformation string         `xml:"CopyrightInformation"`
+}
+
+// String returns the whole abstract as plain text. The sections of a
+// structured abstract are each started with their label, as PubMed shows
+// them.
+func (abstract Abstract) String() string {
+	sections := []string{}
+	for _, abstractText := range abstract.AbstractTexts {
+		text := abstractText.String()
+		if text == "" {
+			continue
+		}
+		if abstractText.Label != "" {
+			text = abstractText.Label + ": " + text
+		}
+		sections = append(sections, text)
+	}
+	return strings.Join(sections, " ")
+}
+
+// Markup returns the whole abstract like String does, but with the inline
+// markup of each section kept as XML.
+func (abstract Abstract) Markup() string {
+	sections := []string{}
+	for _, abstractText := range abstract.AbstractTexts {
+		markup := abstractText.Markup()
+		if markup == "" {
+			continue
+		}
+		if abstractText.Label != "" {
+			markup = abstractText.Label + ": " + markup
+		}
+		sections = append(sections, markup)
+	}
+	return strings.Join(sections, " ")
+}
+
+// AbstractText is a section of an abstract. Label is the heading used by the
+// journal, such as "PATIENTS AND METHODS", and NlmCategory the one of
+// BACKGROUND, OBJECTIVE, METHODS, RESULTS, CONCLUSIONS or UNASSIGNED it was
+// filed under. The text can hold inline markup such as <i> and <sup>, so it
+// is kept as it was.
+type AbstractText struct {
+	Label       string `xml:"Label,attr"`
+	NlmCategory string `xml:"NlmCategory,attr"`
+	InnerXML    string `xml:",innerxml"`
+}
+
+// String returns the section as plain text.
+func (text AbstractText) String() string {
+	return PlainText(text.InnerXML)
+}
+
+// Markup returns the section with its inline markup kept as XML, with runs
+// of whitespace collapsed to a single space.
+func (text AbstractText) Markup() string {
+	return strings.Join(strings.Fields(text.InnerXML), " ")
 }
 
 type AffiliationInfo struct {
@@ -171,14 +259,14 @@ type Article struct {
 	AuthorList          AuthorList        `xml:"AuthorList"`
 	Language            string            `xml:"Language"`
 	GrantList           GrantList         `xml:"GrantList"`
-	PublicationTypeList []PublicationType `xml:"PublicationType"`
+	PublicationTypeList []PublicationType `xml:"PublicationTypeList>PublicationType"`
 	ArticleDate         ArticleDate       `xml:"ArticleDate"`
 }
 
 type PubmedData struct {
-	History           []PubMedPubDate `xml:"History"`
+	History           []PubMedPubDate `xml:"History>PubMedPubDate"`
 	PublicationStatus string          `xml:"PublicationStatus"`
-	ArticleIDList     []ArticleID     `xml:"ArticleIDList"`
+	ArticleIDList     []ArticleID     `xml:"ArticleIdList>ArticleId"`
 }
 
 type PubMedPubDate struct {
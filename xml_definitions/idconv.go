@@ -13,4 +13,6 @@ type Record struct {
 	PMCID     string `xml:"pmcid,attr"`
 	PMID      string `xml:"pmid,attr"`
 	DOI       string `xml:"doi,attr"`
+	Status    string `xml:"status,attr"`
+	ErrMsg    string `xml:"errmsg,attr"`
 }
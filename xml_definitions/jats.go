@@ -0,0 +1,164 @@
+package xml_definitions
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// The JATS (NLM) article XML found as the .nxml file in every PMC package.
+// Only the front matter is described here.
+
+type JATSArticle struct {
+	XMLName xml.Name  `xml:"article"`
+	Front   JATSFront `xml:"front"`
+}
+
+type JATSFront struct {
+	JournalMeta JATSJournalMeta `xml:"journal-meta"`
+	ArticleMeta JATSArticleMeta `xml:"article-meta"`
+}
+
+type JATSJournalMeta struct {
+	JournalIDs   []JATSJournalID `xml:"journal-id"`
+	JournalTitle string          `xml:"journal-title-group>journal-title"`
+	ISSNs        []JATSISSN      `xml:"issn"`
+	Publisher    string          `xml:"publisher>publisher-name"`
+}
+
+type JATSJournalID struct {
+	Type string `xml:"journal-id-type,attr"`
+	ID   string `xml:",chardata"`
+}
+
+type JATSISSN struct {
+	// pub-type is used up to JATS 1.0 and publication-format from 1.1
+	// onwards.
+	PubType           string `xml:"pub-type,attr"`
+	PublicationFormat string `xml:"publication-format,attr"`
+	ISSN              string `xml:",chardata"`
+}
+
+type JATSArticleMeta struct {
+	ArticleIDs   []JATSArticleID `xml:"article-id"`
+	ArticleTitle JATSText        `xml:"title-group>article-title"`
+	Contribs     []JATSContrib   `xml:"contrib-group>contrib"`
+	PubDates     []JATSPubDate   `xml:"pub-date"`
+	Volume       string          `xml:"volume"`
+	Issue        string          `xml:"issue"`
+	FPage        string          `xml:"fpage"`
+	LPage        string          `xml:"lpage"`
+	Licenses     []JATSLicense   `xml:"permissions>license"`
+	Abstracts    []JATSAbstract  `xml:"abstract"`
+	Keywords     []JATSText      `xml:"kwd-group>kwd"`
+}
+
+type JATSArticleID struct {
+	PubIDType string `xml:"pub-id-type,attr"`
+	ID        string `xml:",chardata"`
+}
+
+// A contrib is either a person with a name or a group such as a consortium
+// credited with a collab.
+type JATSContrib struct {
+	ContribType string   `xml:"contrib-type,attr"`
+	Name        JATSName `xml:"name"`
+	Collab      JATSText `xml:"collab"`
+}
+
+type JATSName struct {
+	Surname    string `xml:"surname"`
+	GivenNames string `xml:"given-names"`
+}
+
+type JATSPubDate struct {
+	// pub-type is used up to JATS 1.0 and date-type from 1.1 onwards.
+	PubType  string `xml:"pub-type,attr"`
+	DateType string `xml:"date-type,attr"`
+	Day      string `xml:"day"`
+	Month    string `xml:"month"`
+	Year     string `xml:"year"`
+}
+
+type JATSLicense struct {
+	LicenseType string `xml:"license-type,attr"`
+	Href        string `xml:"http://www.w3.org/1999/xlink href,attr"`
+}
+
+type JATSAbstract struct {
+	AbstractType string `xml:"abstract-type,attr"`
+	InnerXML     string `xml:",innerxml"`
+}
+
+func (abstract JATSAbstract) String() string {
+	return PlainText(abstract.InnerXML)
+}
+
+// JATSText holds mixed content such as a title with <italic> in it.
+type JATSText struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+// String returns the text without any markup and with runs of whitespace
+// collapsed to a single space.
+func (text JATSText) String() string {
+	return PlainText(text.InnerXML)
+}
+
+// The elements of JATS and PubMed XML that mark up text within a line. The
+// words either side of them belong together, so unlike paragraphs and other
+// blocks they are not separated from their neighbours by a space.
+var inlineElements = map[string]bool{
+	"i": true, "b": true, "u": true, "sup": true, "sub": true,
+	"italic": true, "bold": true, "underline": true, "sc": true,
+	"monospace": true, "strike": true, "overline": true, "roman": true,
+	"sans-serif": true, "xref": true, "ext-link": true, "uri": true,
+	"email": true, "named-content": true, "styled-content": true,
+	"inline-formula": true, "math": true,
+}
+
+// PlainText strips the markup from a fragment of XML and collapses runs of
+// whitespace to a single space. A fragment that cannot be parsed is returned
+// as it was, trimmed.
+func PlainText(fragment string) string {
+	decoder := newLenientDecoder(strings.NewReader("<text>" + fragment + "</text>"))
+	var plain strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return strings.Join(strings.Fields(fragment), " ")
+		}
+		switch token := token.(type) {
+		case xml.CharData:
+			plain.Write(token)
+		case xml.StartElement:
+			// Keep words in neighbouring paragraphs apart.
+			if !inlineElements[token.Name.Local] {
+				plain.WriteString(" ")
+			}
+		}
+	}
+	return strings.Join(strings.Fields(plain.String()), " ")
+}
+
+// ParseJATS reads the front matter of a JATS article. Publishers use HTML
+// entities freely, so they are accepted without the DTD.
+func ParseJATS(data []byte) (*JATSArticle, error) {
+	article := JATSArticle{}
+	err := newLenientDecoder(bytes.NewReader(data)).Decode(&article)
+	if err != nil {
+		return nil, err
+	}
+	return &article, nil
+}
+
+func newLenientDecoder(reader io.Reader) *xml.Decoder {
+	decoder := xml.NewDecoder(reader)
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	return decoder
+}